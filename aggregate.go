@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// aggregateNetworks losslessly collapses a list of networks, networks
+// covered by a bigger network in the list are dropped and sibling networks
+// are merged into their parent.
+func aggregateNetworks(networks []*net.IPNet) []*net.IPNet {
+	normalised := make([]*net.IPNet, 0, len(networks))
+	for _, v := range networks {
+		normalised = append(normalised, normaliseNetwork(v))
+	}
+
+	sort.Slice(normalised, func(i, j int) bool {
+		if len(normalised[i].IP) != len(normalised[j].IP) {
+			return len(normalised[i].IP) < len(normalised[j].IP)
+		}
+		if c := bytes.Compare(normalised[i].IP, normalised[j].IP); c != 0 {
+			return c < 0
+		}
+		ones1, _ := normalised[i].Mask.Size()
+		ones2, _ := normalised[j].Mask.Size()
+		return ones1 < ones2
+	})
+
+	var stack []*net.IPNet
+	for _, v := range normalised {
+		if n := len(stack); n > 0 && covers(stack[n-1], v) {
+			continue
+		}
+		stack = append(stack, v)
+
+		for n := len(stack); n > 1; n = len(stack) {
+			parent := siblingParent(stack[n-2], stack[n-1])
+			if parent == nil {
+				break
+			}
+			stack = append(stack[:n-2], parent)
+		}
+	}
+	return stack
+}
+
+// normaliseNetwork returns the network with IPv4 addresses in 4 bytes and
+// the host bits cleared
+func normaliseNetwork(v *net.IPNet) *net.IPNet {
+	ip := v.IP.To4()
+	if ip == nil || len(v.Mask) == net.IPv6len {
+		ip = v.IP.To16()
+	}
+	ones, bits := v.Mask.Size()
+	if len(ip)*8 != bits {
+		// Mixed up IPv4 mapped networks, leave them well alone
+		ip = v.IP
+	}
+	return &net.IPNet{IP: ip.Mask(v.Mask), Mask: net.CIDRMask(ones, bits)}
+}
+
+// covers reports if b is entirely within a
+func covers(a, b *net.IPNet) bool {
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes <= bOnes && a.Contains(b.IP)
+}
+
+// siblingParent returns the network a and b make up when they're the two
+// halves of it
+func siblingParent(a, b *net.IPNet) *net.IPNet {
+	if len(a.IP) != len(b.IP) {
+		return nil
+	}
+	aOnes, bits := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes != bOnes || aOnes == 0 || a.IP.Equal(b.IP) {
+		return nil
+	}
+
+	mask := net.CIDRMask(aOnes-1, bits)
+	parent := a.IP.Mask(mask)
+	if !parent.Equal(a.IP) || !parent.Equal(b.IP.Mask(mask)) {
+		return nil
+	}
+	return &net.IPNet{IP: parent, Mask: mask}
+}
+
+// nextNetwork returns the first address after the network, or nil when the
+// network runs to the end of the address space
+func nextNetwork(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	for i := len(ip) - 1; i >= 0; i-- {
+		if ip[i]++; ip[i] != 0 {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAggregateNetworks(t *testing.T) {
+	tests := []struct {
+		input  []string
+		expect []string
+	}{
+		{
+			input:  []string{"10.0.0.0/24", "10.0.1.0/24"},
+			expect: []string{"10.0.0.0/23"},
+		},
+		{
+			input:  []string{"10.0.1.0/24", "10.0.2.0/24"},
+			expect: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			input:  []string{"10.0.0.0/16", "10.0.5.0/24", "10.0.0.0/16"},
+			expect: []string{"10.0.0.0/16"},
+		},
+		{
+			input:  []string{"10.0.3.0/24", "10.0.0.0/24", "10.0.2.0/24", "10.0.1.0/24", "10.0.4.0/24"},
+			expect: []string{"10.0.0.0/22", "10.0.4.0/24"},
+		},
+		{
+			input:  []string{"2600:1f18::/33", "2600:1f18:8000::/33", "52.95.245.0/24", "52.95.244.0/24"},
+			expect: []string{"52.95.244.0/23", "2600:1f18::/32"},
+		},
+	}
+
+	for _, test := range tests {
+		var input []*net.IPNet
+		for _, v := range test.input {
+			_, n, _ := net.ParseCIDR(v)
+			input = append(input, n)
+		}
+
+		var got []string
+		for _, v := range aggregateNetworks(input) {
+			got = append(got, v.String())
+		}
+
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Expected %v to aggregate to %v got %v", test.input, test.expect, got)
+		}
+	}
+}
+
+func TestNextNetwork(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/24":      "10.0.1.0",
+		"10.0.255.0/24":    "10.1.0.0",
+		"2600:1f18::/32":   "2600:1f19::",
+		"255.255.255.0/24": "<nil>",
+		"::/0":             "<nil>",
+	}
+	for input, expect := range tests {
+		_, n, _ := net.ParseCIDR(input)
+		if got := nextNetwork(n).String(); got != expect {
+			t.Errorf("Expected %s after %s got %s", expect, input, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -10,10 +11,10 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	rice "github.com/GeertJohan/go.rice"
-	gct "github.com/freman/go-commontypes"
 	"github.com/freman/work"
 	"github.com/freman/work/bootstrap"
 )
@@ -27,42 +28,80 @@ type app struct {
 	prefixes   *Prefixes
 	bootstrap  *bootstrap.Bootstrap
 	selections []string
-	customs    []*gct.Network
-	timer      *time.Timer
+	customs    []*CustomRoute
+	sources    []*source
+	applied    *Plan
+	drift      []DriftEvent
+	driftLock  sync.Mutex
+	health     healthState
+	sinks      map[string]Sink
+	sinksLock  sync.Mutex
 	log        *log.Logger
 	ring       *ringWriter
+
+	// customIndex is the custom routes indexed for lookups
+	customIndex *customIndex
+
+	// sourcesLock guards the sources, what each has and the merged prefixes
+	sourcesLock sync.RWMutex
+
+	// pac is the rendered PAC file
+	pac pacCache
 }
 
 const version = `0.0.1`
 const userAgent = `awsrangenf/` + version
 const httpDate = time.RFC1123
 
+const retryMinDelay = 30 * time.Second
+const retryMaxDelay = time.Hour
+
+var errStaleSyncToken = errors.New("syncToken is older than the one already applied")
+
 func (a *app) Run() {
+	var sources []*source
+	for _, cfg := range a.config.sources() {
+		s, err := newSource(cfg)
+		if err != nil {
+			a.log.Println("Not adding source:", err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+	a.sourcesLock.Lock()
+	a.sources = sources
+	a.sourcesLock.Unlock()
+
 	a.bootstrap = &bootstrap.Bootstrap{}
-	a.bootstrap.MkdirAll(a.config.Store, 0755).
-		IsWritable(a.store("ip-ranges.json")).
+	a.bootstrap.MkdirAll(a.config.Store, 0755)
+	for _, s := range sources {
+		a.bootstrap.IsWritable(a.store(s.file))
+	}
+	a.bootstrap.
 		IsWritable(a.store("selections.json")).
 		IsWritable(a.store("customs.json")).
 		Add(func(next work.Task) work.Task {
-			return work.LabelFunc("update prefixes", func(ctx context.Context) error {
-				if err := a.update(); err != nil {
-					a.log.Println("Unable to update prefixes due to", err)
+			return work.LabelFunc("load selections", func(ctx context.Context) error {
+				if err := parseJSON(a.store("selections.json"), &a.selections); err != nil {
+					a.log.Println("Unable to load selections due to", err)
 					return err
 				}
 				return next.Execute(ctx)
 			})
 		}).Add(func(next work.Task) work.Task {
-		return work.LabelFunc("load selections", func(ctx context.Context) error {
-			if err := parseJSON(a.store("selections.json"), &a.selections); err != nil {
-				a.log.Println("Unable to load selections due to", err)
+		return work.LabelFunc("update custom ranges", func(ctx context.Context) error {
+			var customs []*CustomRoute
+			if err := parseJSON(a.store("customs.json"), &customs); err != nil {
+				a.log.Println("Unable to update custom ranges due to", err)
 				return err
 			}
+			a.setCustoms(customs)
 			return next.Execute(ctx)
 		})
 	}).Add(func(next work.Task) work.Task {
-		return work.LabelFunc("update custom ranges", func(ctx context.Context) error {
-			if err := parseJSON(a.store("customs.json"), &a.customs); err != nil {
-				a.log.Println("Unable to update custom ranges due to", err)
+		return work.LabelFunc("update prefixes", func(ctx context.Context) error {
+			if err := a.bootstrapPrefixes(); err != nil {
+				a.log.Println("Unable to update prefixes due to", err)
 				return err
 			}
 			return next.Execute(ctx)
@@ -77,24 +116,13 @@ func (a *app) Run() {
 		})
 	})
 
-	if a.config.Polling.Enabled {
-		a.timer = time.NewTimer(a.config.Polling.Interval.Duration)
-	} else {
-		a.timer = time.NewTimer(5 * time.Minute)
-		a.timer.Stop()
-	}
-
 	a.runServer()
-	go a.pollingUpdate()
-	go a.performUpdate()
-}
-
-func (a *app) pollingUpdate() {
-	for _ = range a.timer.C {
-		a.log.Println("Polling for new ip-ranges.json")
-		a.update()
-		SetRoutes(a)
+	for _, s := range sources {
+		go a.pollingUpdate(s)
 	}
+	go watchRoutes(a)
+	go a.healthChecks()
+	go a.performUpdate()
 }
 
 func (a *app) performUpdate() {
@@ -116,17 +144,13 @@ func (a *app) Shutdown(ctx context.Context) error {
 func (a *app) Reload(cfg *Config) {
 	a.log.Println("Reloading configuration")
 	serverRestart := a.config.Listen != cfg.Listen || a.config.Webhook.Enabled != cfg.Webhook.Enabled
-	pollingEnabledChanged := a.config.Polling.Enabled != cfg.Polling.Enabled
-	pollingIntervalChanged := a.config.Polling.Interval.Duration != cfg.Polling.Interval.Duration
 	a.config = cfg
+	a.reloadSources()
+	a.invalidatePAC()
 
-	if pollingEnabledChanged || pollingIntervalChanged {
-		if a.config.Polling.Enabled {
-			a.log.Println("Polling change detected, enabling polling every", a.config.Polling.Interval.Duration)
-			a.timer.Reset(a.config.Polling.Interval.Duration)
-		} else {
-			a.log.Println("Polling change detected, disabling polling")
-			a.timer.Stop()
+	if a.ready() {
+		if err := SetRoutes(a); err != nil {
+			a.log.Println("Unable to apply routes after reload due to", err)
 		}
 	}
 
@@ -143,12 +167,24 @@ func (a *app) store(file string) string {
 	return filepath.Join(a.config.Store, file)
 }
 
+// update refreshes every source, an error from one source doesn't stop the
+// others from being refreshed
 func (a *app) update() error {
+	var firstErr error
+	for _, s := range a.sourceList() {
+		if err := a.updateSource(s); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *app) updateSource(s *source) error {
 	httpClient := &http.Client{
 		Timeout: a.config.Timeout.Duration,
 	}
 
-	req, err := http.NewRequest(http.MethodGet, a.config.URL.String(), nil)
+	req, err := http.NewRequest(http.MethodGet, s.config.URL.String(), nil)
 	if err != nil {
 		return err
 	}
@@ -156,7 +192,7 @@ func (a *app) update() error {
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Accept", `application/json`)
 
-	if stat, _ := os.Stat(a.store("ip-ranges.json")); stat != nil {
+	if stat, _ := os.Stat(a.store(s.file)); stat != nil {
 		req.Header.Set("If-Modified-Since", stat.ModTime().Format(httpDate))
 	}
 
@@ -166,64 +202,302 @@ func (a *app) update() error {
 	}
 	defer resp.Body.Close()
 
-	var rdr io.Reader
+	var prefixes *Prefixes
 	switch resp.StatusCode {
 	case http.StatusOK:
-		a.log.Println("Change detected, downloading new ip-ranges.json")
-		file, err := os.OpenFile(a.store("ip-ranges.json"), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		rdr = io.TeeReader(resp.Body, file)
+		a.log.Println("Change detected, downloading new", s.file)
+		prefixes, err = a.download(s, resp.Body)
 	case http.StatusNotModified:
-		a.log.Println("No change found, reloading ip-ranges.json")
-		rdr, err = os.Open(a.store("ip-ranges.json"))
-		if err != nil {
-			return err
-		}
-		defer rdr.(io.Closer).Close()
+		a.log.Println("No change found, reloading", s.file)
+		prefixes, err = a.loadCached(s)
 	default:
 		a.log.Println("Unexpected http response:", resp.Status)
 		return errors.New("unexpected http response")
 	}
-
-	prefixes, err := ParseAWSIPRanges(a.config.IPv6, rdr)
 	if err != nil {
-		os.Remove(a.store("ip-ranges.json"))
 		return err
 	}
-	a.prefixes = prefixes
+
+	a.refreshed(s, prefixes, false, nil)
 	return nil
 }
 
-func (a *app) wantedRoutes() []*net.IPNet {
-	prefixes := a.prefixes.Filter(a.selections)
-	customLen := len(a.customs)
-	prefixLen := len(prefixes)
-	totalLen := customLen + prefixLen
+// bootstrapPrefixes loads the cached copy of every source so routes can be
+// programmed straight away and refreshes them in the background. Only AWS
+// is fetched before carrying on when it has no cached copy, nothing can be
+// programmed without it. Sources that can't be refreshed keep retrying.
+func (a *app) bootstrapPrefixes() error {
+	var firstErr error
+	for _, s := range a.sourceList() {
+		prefixes, err := a.loadCached(s)
+		if err == nil {
+			a.log.Println("Using cached", s.file, "from", prefixes.CreateDate, "until it's refreshed")
+			a.refreshed(s, prefixes, true, nil)
+			a.refreshLater(s, 0)
+			continue
+		}
+		if s.name != defaultNamespace {
+			a.log.Println("Carrying on without", s.name, "until it can be refreshed")
+			a.refreshLater(s, 0)
+			continue
+		}
 
-	wantedRoutes := make([]*net.IPNet, totalLen)
-	for i, v := range a.customs {
-		wantedRoutes[i] = v.IPNet
+		if err := a.updateSource(s); err != nil {
+			a.log.Println("Unable to update", s.file, "due to", err)
+			a.failed(s, err)
+			a.refreshLater(s, retryMinDelay)
+			firstErr = err
+		}
 	}
-	for i, v := range prefixes {
-		wantedRoutes[customLen+i] = v.Prefix
+	return firstErr
+}
+
+// refreshLater refreshes the source in the background after the delay
+func (a *app) refreshLater(s *source, delay time.Duration) {
+	if a.startRetry(s) {
+		go a.retryUpdate(s, delay)
+	}
+}
+
+// startRetry reports if the source needs a background refresh started,
+// there's only ever one refreshing each source
+func (a *app) startRetry(s *source) bool {
+	a.sourcesLock.Lock()
+	defer a.sourcesLock.Unlock()
+
+	if s.retrying {
+		return false
 	}
+	s.retrying = true
+	return true
+}
 
-	seen, i := make(map[string]struct{}, len(wantedRoutes)), 0
-	for _, v := range wantedRoutes {
-		if _, ok := seen[v.String()]; ok {
+// retryUpdate keeps trying to refresh a source after the delay with an
+// exponential backoff, routes are only refreshed once AWS has something to
+// offer
+func (a *app) retryUpdate(s *source, delay time.Duration) {
+	defer func() {
+		a.sourcesLock.Lock()
+		s.retrying = false
+		a.sourcesLock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+
+		err := a.updateSource(s)
+		if err == nil {
+			a.log.Println("Refreshed", s.file)
+			if a.ready() {
+				SetRoutes(a)
+			}
+			return
+		}
+
+		a.failed(s, err)
+		if delay *= 2; delay < retryMinDelay {
+			delay = retryMinDelay
+		} else if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		a.log.Println("Still unable to update", s.file, "due to", err, "will retry in", delay)
+	}
+}
+
+// ready reports if AWS has prefixes, stale or otherwise. The other sources
+// are optional, their prefixes are added whenever they turn up
+func (a *app) ready() bool {
+	a.sourcesLock.RLock()
+	defer a.sourcesLock.RUnlock()
+
+	for _, s := range a.sources {
+		if s.name == defaultNamespace {
+			return s.prefixes != nil
+		}
+	}
+	return false
+}
+
+// download writes the body to a temporary file and only once it has been
+// validated replaces the cached copy, keeping the previous one as a backup
+func (a *app) download(s *source, body io.Reader) (*Prefixes, error) {
+	tmp := a.store(s.file + ".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes, err := a.parseFile(s, tmp)
+	if err != nil {
+		a.log.Println("Discarding download of", s.file, "due to", err)
+		return nil, err
+	}
+
+	if err := a.validate(s, prefixes); err != nil {
+		a.log.Println("Discarding download of", s.file, "due to", err)
+		return nil, err
+	}
+
+	if _, err := os.Stat(a.store(s.file)); err == nil {
+		if err := keepBackup(a.store(s.file)); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, a.store(s.file)); err != nil {
+		return nil, err
+	}
+
+	if err := a.snapshot(s, prefixes); err != nil {
+		a.log.Println("Unable to keep a snapshot of", s.file, "due to", err)
+	}
+	return prefixes, nil
+}
+
+// keepBackup links, or failing that copies, the file to its backup. The
+// file itself stays put so a crash never leaves the cache missing
+func keepBackup(file string) error {
+	tmp := file + ".bak.tmp"
+	os.Remove(tmp)
+	if err := os.Link(file, tmp); err == nil {
+		return os.Rename(tmp, file+".bak")
+	}
+	return copyFile(file, file+".bak")
+}
+
+// loadCached parses the cached copy of a source, falling back to the backup
+// of the previous copy if the cache can't be read
+func (a *app) loadCached(s *source) (*Prefixes, error) {
+	prefixes, err := a.parseFile(s, a.store(s.file))
+	if err == nil {
+		return prefixes, nil
+	}
+
+	a.log.Println("Unable to load", s.file, "due to", err, "trying the backup")
+	prefixes, berr := a.parseFile(s, a.store(s.file+".bak"))
+	if berr != nil {
+		// Remove the broken copy so the next update isn't conditional
+		os.Remove(a.store(s.file))
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+func (a *app) parseFile(s *source, file string) (*Prefixes, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return s.provider.Parse(a.config.IPv6, f)
+}
+
+// validate checks a freshly downloaded range list is fit to replace the
+// one already applied, or failing that the one in the cache
+func (a *app) validate(s *source, prefixes *Prefixes) error {
+	minimum := s.config.MinPrefixes
+	if minimum < 1 {
+		minimum = 1
+	}
+	if len(prefixes.PrefixList) < minimum {
+		return fmt.Errorf("only %d prefixes, expected at least %d", len(prefixes.PrefixList), minimum)
+	}
+
+	a.sourcesLock.RLock()
+	current := s.prefixes
+	a.sourcesLock.RUnlock()
+	if current == nil {
+		current, _ = a.parseFile(s, a.store(s.file))
+	}
+	if current != nil && prefixes.SyncToken < current.SyncToken {
+		a.log.Printf("Refusing %s with syncToken %d, already have %d", s.file, prefixes.SyncToken, current.SyncToken)
+		return errStaleSyncToken
+	}
+	return nil
+}
+
+// routes is every route that should be programmed and how, aggregated if
+// that's been asked for
+func (a *app) routes() []*Route {
+	return a.routesWith(a.selections, a.customs)
+}
+
+// routesWith is every route that should be programmed for the selections
+// and custom routes, for planning changes before they're made
+func (a *app) routesWith(selections []string, customs []*CustomRoute) []*Route {
+	routes := a.failover(a.selectedRoutesWith(selections, customs))
+	if a.config.Route.Aggregate {
+		return aggregateRoutes(routes)
+	}
+	return routes
+}
+
+// wantedRoutes is the destination of every route that should be programmed
+func (a *app) wantedRoutes() []*net.IPNet {
+	return destinations(a.routes())
+}
+
+// destinations is where the routes go, each only once and in order
+func destinations(routes []*Route) []*net.IPNet {
+	wantedRoutes := make([]*net.IPNet, 0, len(routes))
+	seen := make(map[string]struct{}, len(routes))
+	for _, v := range routes {
+		if _, ok := seen[v.Dst.String()]; ok {
 			continue
 		}
-		seen[v.String()] = struct{}{}
-		wantedRoutes[i] = v
-		i++
+		seen[v.Dst.String()] = struct{}{}
+		wantedRoutes = append(wantedRoutes, v.Dst)
 	}
 
-	sort.Slice(wantedRoutes[:i], func(i, j int) bool {
+	sort.Slice(wantedRoutes, func(i, j int) bool {
 		return wantedRoutes[i].String() < wantedRoutes[j].String()
 	})
+	return wantedRoutes
+}
+
+// selectedRoutes is the deduplicated custom routes and selected prefixes,
+// custom routes win over selections and earlier selections over later ones
+func (a *app) selectedRoutes() []*Route {
+	return a.selectedRoutesWith(a.selections, a.customs)
+}
+
+func (a *app) selectedRoutesWith(selections []string, customs []*CustomRoute) []*Route {
+	prefixes, selectors := a.mergedPrefixes().FilterSelectors(selections)
+
+	routes := make([]*Route, 0, len(customs)+len(prefixes))
+	for _, v := range customs {
+		routes = append(routes, a.config.resolveRoute(v.IPNet, v.RouteAttrs))
+	}
+	for i, v := range prefixes {
+		routes = append(routes, a.config.resolveRoute(v.Prefix, selectors[i].Attrs))
+	}
+
+	seen, i := make(map[string]struct{}, len(routes)), 0
+	for _, v := range routes {
+		if _, ok := seen[v.key()]; ok {
+			continue
+		}
+		seen[v.key()] = struct{}{}
+		routes[i] = v
+		i++
+	}
 
-	return wantedRoutes[:i]
+	sortRoutes(routes[:i])
+	return routes[:i]
 }
@@ -2,15 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/freman/awsrangenf/sns"
-	gct "github.com/freman/go-commontypes"
 	"github.com/freman/work/bootstrap"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -26,19 +29,27 @@ func orError(w http.ResponseWriter, code int, err error) error {
 
 func (a *app) runServer() {
 	r := mux.NewRouter()
+	r.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+		return a.config.PAC.Enabled && r.URL.Path == a.config.PAC.Path
+	}).HandlerFunc(a.pacHandler())
 	r.HandleFunc("/", a.indexHandler())
 	if a.box != nil {
 		r.PathPrefix("/js").Handler(http.FileServer(a.box.HTTPBox()))
 		r.PathPrefix("/css").Handler(http.FileServer(a.box.HTTPBox()))
 	}
 	r.HandleFunc("/api/v1/config", a.configHandler())
+	r.HandleFunc("/api/v1/changes", a.changesHandler())
 	r.HandleFunc("/api/v1/custom", a.customHandler())
 	r.HandleFunc("/api/v1/dashboard", a.dashboardHandler())
+	r.HandleFunc("/api/v1/export/{format}", a.exportHandler())
 	r.HandleFunc("/api/v1/imports", a.importsHandler())
+	r.HandleFunc("/api/v1/lookup", a.lookupHandler())
+	r.HandleFunc("/api/v1/plan", a.planHandler())
+	r.HandleFunc("/api/v1/rules", a.rulesHandler())
 	r.HandleFunc("/hook/{key}", a.hookHandler())
 
 	corsHandler := handlers.CORS(
-		handlers.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodOptions}),
+		handlers.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions}),
 		handlers.AllowedOrigins([]string{"*"}),
 		handlers.AllowedHeaders([]string{"Origin", "Content-Type"}),
 	)
@@ -121,7 +132,7 @@ func (a *app) hookHandler() http.HandlerFunc {
 		b, _ := httputil.DumpRequest(r, true)
 		fmt.Println(string(b))
 
-		a.update()
+		a.updateSource(a.source(defaultNamespace))
 		SetRoutes(a)
 	}
 }
@@ -149,6 +160,9 @@ func (a *app) configHandler() http.HandlerFunc {
 				return
 			}
 			newcfg.Listen = a.config.Listen
+			if err := orError(w, http.StatusBadRequest, validateConfig(&newcfg)); err != nil {
+				return
+			}
 
 			if err := orError(w, http.StatusInternalServerError, saveConfig(a.configFile, &newcfg)); err != nil {
 				return
@@ -170,9 +184,20 @@ func (a *app) dashboardHandler() http.HandlerFunc {
 		Label    string `json:",omitempty"`
 		Error    string `json:",omitempty"`
 	}
+	type staleSource struct {
+		Source     string
+		CreateDate time.Time
+		Error      string `json:",omitempty"`
+	}
 	type dashboardResponse struct {
 		Bootstrap bootstrapStatus
 		Cards     map[string]interface{}
+		Stale     []staleSource   `json:",omitempty"`
+		Drift     []DriftEvent    `json:",omitempty"`
+		Gateways  []GatewayStatus `json:",omitempty"`
+		Health    []HealthEvent   `json:",omitempty"`
+		Peers     []BGPPeerStatus `json:",omitempty"`
+		Sinks     []SinkStatus
 		Logs      []string
 	}
 	type Labelled interface {
@@ -192,16 +217,59 @@ func (a *app) dashboardHandler() http.HandlerFunc {
 					}
 				}
 			})
+			prefixes := a.mergedPrefixes()
 			resp := dashboardResponse{
 				Bootstrap: bootstrapStatus{
 					Finished: a.run.Finished(),
 				},
 				Cards: map[string]interface{}{
-					"AWS Prefixes":  fmt.Sprintf("%d / %d", len(a.prefixes.Filter(a.selections)), len(a.prefixes.PrefixList)),
 					"Custom Routes": len(a.customs),
+					"Sync Token":    prefixes.SyncToken,
+					"Create Date":   prefixes.CreateDate,
 				},
-				Logs: logs,
+				Drift: a.driftEvents(),
+				Logs:  logs,
+			}
+			if a.config.Health.Enabled {
+				resp.Gateways, resp.Health = a.health.status(a.config)
+			}
+			resp.Peers = a.bgpStatus()
+			resp.Sinks = a.sinkStatus()
+
+			routes := a.selectedRoutes()
+			if a.config.Route.Aggregate {
+				resp.Cards["Routes"] = fmt.Sprintf("%d aggregated from %d", len(aggregateRoutes(routes)), len(routes))
+			} else {
+				resp.Cards["Routes"] = len(routes)
+			}
+
+			if a.applied != nil {
+				if foreign := len(a.applied.Foreign) + len(a.applied.ForeignRules); foreign > 0 {
+					resp.Cards["Foreign Routes"] = foreign
+				}
+			}
+
+			selected := map[string]int{}
+			for _, prefix := range prefixes.Filter(a.selections) {
+				selected[prefix.Namespace()]++
 			}
+			a.sourcesLock.RLock()
+			for _, s := range a.sources {
+				total := 0
+				if s.prefixes != nil {
+					total = len(s.prefixes.PrefixList)
+				}
+				resp.Cards[strings.ToUpper(s.name)+" Prefixes"] = fmt.Sprintf("%d / %d", selected[s.name], total)
+
+				if s.stale {
+					stale := staleSource{Source: s.name, CreateDate: s.prefixes.CreateDate}
+					if s.err != nil {
+						stale.Error = s.err.Error()
+					}
+					resp.Stale = append(resp.Stale, stale)
+				}
+			}
+			a.sourcesLock.RUnlock()
 
 			if task := a.run.Task(); task != nil {
 				if l, isa := task.(Labelled); isa {
@@ -225,11 +293,13 @@ func (a *app) dashboardHandler() http.HandlerFunc {
 
 func (a *app) importsHandler() http.HandlerFunc {
 	type Selections struct {
-		Count           int
-		Total           int
-		Filter          []string
-		RegionToService map[string][]string `json:",omitempty"`
-		ServiceToRegion map[string][]string `json:",omitempty"`
+		Count                int
+		Total                int
+		Filter               []string
+		RegionToService      map[string][]string `json:",omitempty"`
+		ServiceToRegion      map[string][]string `json:",omitempty"`
+		BorderGroupToService map[string][]string `json:",omitempty"`
+		ServiceToBorderGroup map[string][]string `json:",omitempty"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -237,12 +307,15 @@ func (a *app) importsHandler() http.HandlerFunc {
 		enc := json.NewEncoder(w)
 		switch r.Method {
 		case http.MethodGet:
+			prefixes := a.mergedPrefixes()
 			enc.Encode(&Selections{
-				Filter:          a.selections,
-				RegionToService: a.prefixes.RegionToService,
-				ServiceToRegion: a.prefixes.ServiceToRegion,
-				Count:           len(a.prefixes.Filter(a.selections)),
-				Total:           len(a.prefixes.PrefixList),
+				Filter:               a.selections,
+				RegionToService:      prefixes.RegionToService,
+				ServiceToRegion:      prefixes.ServiceToRegion,
+				BorderGroupToService: prefixes.BorderGroupToService,
+				ServiceToBorderGroup: prefixes.ServiceToBorderGroup,
+				Count:                len(prefixes.Filter(a.selections)),
+				Total:                len(prefixes.PrefixList),
 			})
 		case http.MethodPost:
 			defer r.Body.Close()
@@ -253,6 +326,15 @@ func (a *app) importsHandler() http.HandlerFunc {
 				return
 			}
 
+			if _, err := ParseSelectors(tmp); orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+
+			if dryRun(r) {
+				a.encodePlan(w, enc, a.routesWith(tmp, a.customs))
+				return
+			}
+
 			if err := orError(w, http.StatusInternalServerError, saveJSON(a.store("selections.json"), &tmp)); err != nil {
 				return
 			}
@@ -263,12 +345,15 @@ func (a *app) importsHandler() http.HandlerFunc {
 				return
 			}
 
+			prefixes := a.mergedPrefixes()
 			enc.Encode(&Selections{
-				Filter:          a.selections,
-				RegionToService: a.prefixes.RegionToService,
-				ServiceToRegion: a.prefixes.ServiceToRegion,
-				Count:           len(a.prefixes.Filter(a.selections)),
-				Total:           len(a.prefixes.PrefixList),
+				Filter:               a.selections,
+				RegionToService:      prefixes.RegionToService,
+				ServiceToRegion:      prefixes.ServiceToRegion,
+				BorderGroupToService: prefixes.BorderGroupToService,
+				ServiceToBorderGroup: prefixes.ServiceToBorderGroup,
+				Count:                len(prefixes.Filter(a.selections)),
+				Total:                len(prefixes.PrefixList),
 			})
 		}
 	}
@@ -284,17 +369,22 @@ func (a *app) customHandler() http.HandlerFunc {
 		case http.MethodPost:
 			defer r.Body.Close()
 			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1e6))
-			var tmp []*gct.Network
+			var tmp []*CustomRoute
 
 			if err := orError(w, http.StatusBadRequest, dec.Decode(&tmp)); err != nil {
 				return
 			}
 
+			if dryRun(r) {
+				a.encodePlan(w, enc, a.routesWith(a.selections, tmp))
+				return
+			}
+
 			if err := orError(w, http.StatusInternalServerError, saveJSON(a.store("customs.json"), &tmp)); err != nil {
 				return
 			}
 
-			a.customs = tmp
+			a.setCustoms(tmp)
 
 			if err := orError(w, http.StatusInternalServerError, SetRoutes(a)); err != nil {
 				return
@@ -304,3 +394,228 @@ func (a *app) customHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// planHandler shows what programming the current routes would change
+func (a *app) planHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		switch r.Method {
+		case http.MethodGet:
+			a.encodePlan(w, enc, a.routes())
+		}
+	}
+}
+
+// dryRun reports if the request only wants to see the plan for a change
+func dryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return dryRun
+}
+
+func (a *app) encodePlan(w http.ResponseWriter, enc *json.Encoder, routes []*Route) {
+	plan, err := PlanRoutes(a, routes)
+	if orError(w, http.StatusInternalServerError, err) != nil {
+		return
+	}
+	if plan.Add == nil {
+		plan.Add = []*Route{}
+	}
+	if plan.Remove == nil {
+		plan.Remove = []*Route{}
+	}
+	if plan.Sinks, err = a.planSinks(routes); orError(w, http.StatusInternalServerError, err) != nil {
+		return
+	}
+	enc.Encode(plan)
+}
+
+func (a *app) changesHandler() http.HandlerFunc {
+	type changesResponse struct {
+		Source    string
+		Sources   []string
+		Snapshots []int64
+		From      int64          `json:",omitempty"`
+		To        int64          `json:",omitempty"`
+		Added     []PrefixChange `json:",omitempty"`
+		Removed   []PrefixChange `json:",omitempty"`
+	}
+
+	parseKey := func(v string) (int64, error) {
+		if v == "" {
+			return 0, nil
+		}
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			resp := changesResponse{Source: query.Get("source")}
+			if resp.Source == "" {
+				resp.Source = defaultNamespace
+			}
+			for _, s := range a.sourceList() {
+				resp.Sources = append(resp.Sources, s.name)
+			}
+
+			s := a.source(resp.Source)
+			if s == nil {
+				orError(w, http.StatusNotFound, fmt.Errorf("unknown source %q", resp.Source))
+				return
+			}
+
+			var err error
+			if resp.Snapshots, err = a.snapshots(s); orError(w, http.StatusInternalServerError, err) != nil {
+				return
+			}
+			if resp.From, err = parseKey(query.Get("from")); orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+			if resp.To, err = parseKey(query.Get("to")); orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+
+			// Default to what changed in the most recent update
+			if n := len(resp.Snapshots); resp.To == 0 && n > 0 {
+				resp.To = resp.Snapshots[n-1]
+			}
+			if n := len(resp.Snapshots); resp.From == 0 && n > 1 {
+				resp.From = resp.Snapshots[n-2]
+			}
+
+			if resp.From != 0 && resp.To != 0 {
+				resp.Added, resp.Removed, err = a.diffSnapshots(s, resp.From, resp.To, a.selections)
+				if err == errNoSnapshot {
+					orError(w, http.StatusNotFound, err)
+					return
+				}
+				if orError(w, http.StatusInternalServerError, err) != nil {
+					return
+				}
+			}
+
+			enc.Encode(&resp)
+		}
+	}
+}
+
+// exportHandler renders the selected prefixes as configuration for another
+// router, the gateways, table and list name can be set in the query
+func (a *app) exportHandler() http.HandlerFunc {
+	parseGateway := func(v string) (net.IP, error) {
+		if v == "" {
+			return nil, nil
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("invalid gateway %q", v)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			exporter, found := exporters[mux.Vars(r)["format"]]
+			if !found {
+				orError(w, http.StatusNotFound, fmt.Errorf("unknown export format, expected one of: %s", strings.Join(exportFormats(), ", ")))
+				return
+			}
+
+			query := r.URL.Query()
+			gateway, err := parseGateway(query.Get("gateway"))
+			if orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+			gateway6, err := parseGateway(query.Get("gateway6"))
+			if orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+
+			e, err := a.export(a.routes(), query.Get("name"), query.Get("table"), gateway, gateway6)
+			if orError(w, http.StatusBadRequest, err) != nil {
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain")
+			exporter(w, e)
+		}
+	}
+}
+
+// pacHandler serves a proxy auto-config file for the routes, it's rendered
+// once and kept until the prefixes, selections or configuration change
+func (a *app) pacHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(a.renderedPAC())
+		}
+	}
+}
+
+func (a *app) lookupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		switch r.Method {
+		case http.MethodGet:
+			ip := net.ParseIP(r.URL.Query().Get("ip"))
+			if ip == nil {
+				orError(w, http.StatusBadRequest, fmt.Errorf("invalid ip %q", r.URL.Query().Get("ip")))
+				return
+			}
+			enc.Encode(a.lookup(ip))
+		}
+	}
+}
+
+// rulesHandler shows the ip rules being managed, deleting them drops them
+// from the configuration so they're removed from the kernel
+func (a *app) rulesHandler() http.HandlerFunc {
+	type rulesResponse struct {
+		Managed bool
+		Rules   []string
+	}
+
+	response := func() rulesResponse {
+		resp := rulesResponse{Managed: a.config.Route.ManageRules, Rules: []string{}}
+		if resp.Managed {
+			for _, v := range a.config.rules() {
+				resp.Rules = append(resp.Rules, v.String())
+			}
+		}
+		return resp
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		switch r.Method {
+		case http.MethodGet:
+			enc.Encode(response())
+		case http.MethodDelete:
+			if !a.config.Route.ManageRules {
+				orError(w, http.StatusConflict, errors.New("rules aren't managed, set manage_rules in the configuration"))
+				return
+			}
+
+			if err := orError(w, http.StatusInternalServerError, removeRules(a)); err != nil {
+				return
+			}
+
+			// Rules are left unmanaged until the configuration is reloaded,
+			// the configuration file itself isn't touched
+			newcfg := *a.config
+			newcfg.Route.ManageRules = false
+			a.config = &newcfg
+
+			enc.Encode(response())
+		}
+	}
+}
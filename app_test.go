@@ -1,15 +1,25 @@
 package main
 
 import (
+	"io/ioutil"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	gct "github.com/freman/go-commontypes"
 )
 
 func TestWantedRoutes(t *testing.T) {
 	a := &app{
+		config: &Config{},
 		prefixes: &Prefixes{
 			PrefixList: []Prefix{
 				Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x12, 0xd0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xf8, 0x0, 0x0}}, Region: "us-east-1", Service: "AMAZON"},
@@ -19,9 +29,9 @@ func TestWantedRoutes(t *testing.T) {
 			ServiceToRegion: map[string][]string{"AMAZON": {"us-east-1"}},
 		},
 		selections: []string{"us-east-1:*"},
-		customs: []*gct.Network{
-			&gct.Network{IPNet: &net.IPNet{IP: net.IP{0xa, 0xa, 0xa, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}},
-			&gct.Network{IPNet: &net.IPNet{IP: net.IP{0xc0, 0xa8, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}},
+		customs: []*CustomRoute{
+			&CustomRoute{IPNet: &net.IPNet{IP: net.IP{0xa, 0xa, 0xa, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}},
+			&CustomRoute{IPNet: &net.IPNet{IP: net.IP{0xc0, 0xa8, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}},
 		},
 	}
 
@@ -37,3 +47,200 @@ func TestWantedRoutes(t *testing.T) {
 		t.Errorf("Expected %v got %v", expected, got)
 	}
 }
+
+func TestDownloadKeepsLastKnownGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &app{
+		config: &Config{Store: dir},
+		log:    log.New(ioutil.Discard, "", 0),
+	}
+	s, _ := newSource(SourceConfig{Name: defaultNamespace, Provider: defaultNamespace})
+
+	if _, err := a.download(s, strings.NewReader(sampleJson)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stale := strings.Replace(sampleJson, "1531345951", "1531345000", 1)
+	if _, err := a.download(s, strings.NewReader(stale)); err != errStaleSyncToken {
+		t.Errorf("Expected a stale syncToken error got %v", err)
+	}
+
+	if _, err := a.download(s, strings.NewReader(`{"prefixes": [`)); err == nil {
+		t.Error("Expected an error from a truncated download")
+	}
+
+	if _, err := a.download(s, strings.NewReader(`{"syncToken": "1531346000", "prefixes": []}`)); err == nil {
+		t.Error("Expected an error from an empty download")
+	}
+
+	prefixes, err := a.loadCached(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if prefixes.SyncToken != 1531345951 {
+		t.Errorf("Expected the last known good copy to be kept got %d", prefixes.SyncToken)
+	}
+
+	newer := strings.Replace(sampleJson, "1531345951", "1531346000", 1)
+	if _, err := a.download(s, strings.NewReader(newer)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	backup, err := a.parseFile(s, filepath.Join(dir, "ip-ranges.json.bak"))
+	if err != nil {
+		t.Fatalf("Expected a backup of the previous copy: %v", err)
+	}
+	if backup.SyncToken != 1531345951 {
+		t.Errorf("Expected the backup to be the previous copy got %d", backup.SyncToken)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ip-ranges.json.tmp")); !os.IsNotExist(err) {
+		t.Error("Expected the temporary download to be removed")
+	}
+}
+
+func TestBootstrapFromCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip-ranges.json"), []byte(sampleJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "offline", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	a := &app{
+		config: &Config{Store: dir, URL: gct.URL{URL: u}},
+		log:    log.New(ioutil.Discard, "", 0),
+	}
+	for _, cfg := range a.config.sources() {
+		s, err := newSource(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.sources = append(a.sources, s)
+	}
+	defer a.sources[0].stop()
+
+	if err := a.bootstrapPrefixes(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !a.sources[0].stale {
+		t.Error("Expected the source to be marked stale")
+	}
+	if len(a.prefixes.PrefixList) != 2 {
+		t.Errorf("Expected the cached prefixes to be loaded got %d", len(a.prefixes.PrefixList))
+	}
+}
+
+func TestBootstrapDoesNotWaitForRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip-ranges.json"), []byte(sampleJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	a := &app{
+		config: &Config{Store: dir, URL: gct.URL{URL: u}, Timeout: gct.Duration{Duration: time.Minute}},
+		log:    log.New(ioutil.Discard, "", 0),
+	}
+	for _, cfg := range a.config.sources() {
+		s, err := newSource(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.sources = append(a.sources, s)
+	}
+	defer a.sources[0].stop()
+
+	if err := a.bootstrapPrefixes(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !a.ready() || len(a.mergedPrefixes().PrefixList) != 2 {
+		t.Error("Expected the cached prefixes to be used before the refresh finished")
+	}
+
+	stale := func() bool {
+		a.sourcesLock.RLock()
+		defer a.sourcesLock.RUnlock()
+		return a.sources[0].stale
+	}
+	close(release)
+	for i := 0; i < 100 && stale(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stale() {
+		t.Error("Expected the source to be refreshed in the background")
+	}
+}
+
+func TestBootstrapWithoutOptionalSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ip-ranges.json"), []byte(sampleJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "offline", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	a := &app{
+		config: &Config{
+			Store:   dir,
+			URL:     gct.URL{URL: u},
+			Sources: []SourceConfig{{Name: "gcp", Provider: "gcp", URL: gct.URL{URL: u}}},
+		},
+		log: log.New(ioutil.Discard, "", 0),
+	}
+	for _, cfg := range a.config.sources() {
+		s, err := newSource(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.sources = append(a.sources, s)
+	}
+	defer a.sources[0].stop()
+	defer a.sources[1].stop()
+
+	for i := 0; i < 2; i++ {
+		if err := a.bootstrapPrefixes(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if !a.ready() {
+		t.Error("Expected to be ready without the optional source")
+	}
+	if a.startRetry(a.sources[1]) {
+		t.Error("Expected the optional source to already be retrying")
+	}
+}
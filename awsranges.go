@@ -7,28 +7,50 @@ import (
 	"io/ioutil"
 	"net"
 	"sort"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// createDateLayout is the format AWS uses for the createDate field
+const createDateLayout = "2006-01-02-15-04-05"
+
 type FilteredCache struct {
-	m        sync.Mutex
-	Prefixes []Prefix
-	Filter   []string
+	m         sync.Mutex
+	Prefixes  []Prefix
+	Selectors []*Selector
+	Filter    []string
 }
 
 type Prefix struct {
-	IPv6    bool
-	Prefix  *net.IPNet
-	Region  string
-	Service string
+	IPv6               bool
+	Prefix             *net.IPNet
+	Region             string
+	NetworkBorderGroup string `json:",omitempty"`
+	Service            string
+	Provider           string `json:",omitempty"`
+}
+
+// Namespace returns the selection namespace the prefix belongs to
+func (p Prefix) Namespace() string {
+	if p.Provider == "" {
+		return defaultNamespace
+	}
+	return p.Provider
 }
 
 type Prefixes struct {
-	Cache           FilteredCache
-	PrefixList      []Prefix
-	RegionToService map[string][]string
-	ServiceToRegion map[string][]string
+	Cache                FilteredCache
+	SyncToken            int64
+	CreateDate           time.Time
+	PrefixList           []Prefix
+	RegionToService      map[string][]string
+	ServiceToRegion      map[string][]string
+	BorderGroupToService map[string][]string
+	ServiceToBorderGroup map[string][]string
+
+	indexOnce sync.Once
+	index     *prefixTrie
 }
 
 func unmarshalCIDR(dec *json.Decoder) (*net.IPNet, error) {
@@ -56,6 +78,8 @@ func (p *Prefixes) unmarshalPrefix(dec *json.Decoder) (prefix Prefix, err error)
 				prefix.Prefix, err = unmarshalCIDR(dec)
 			case "region":
 				err = dec.Decode(&prefix.Region)
+			case "network_border_group":
+				err = dec.Decode(&prefix.NetworkBorderGroup)
 			case "service":
 				err = dec.Decode(&prefix.Service)
 			}
@@ -65,10 +89,35 @@ func (p *Prefixes) unmarshalPrefix(dec *json.Decoder) (prefix Prefix, err error)
 		}
 	}
 	dec.Token() // Discard the }
+	return
+}
+
+func newPrefixes() *Prefixes {
+	return &Prefixes{
+		RegionToService:      map[string][]string{},
+		ServiceToRegion:      map[string][]string{},
+		BorderGroupToService: map[string][]string{},
+		ServiceToBorderGroup: map[string][]string{},
+	}
+}
 
+func (p *Prefixes) addPrefix(prefix Prefix) {
+	p.PrefixList = append(p.PrefixList, prefix)
 	p.RegionToService[prefix.Region] = append(p.RegionToService[prefix.Region], prefix.Service)
 	p.ServiceToRegion[prefix.Service] = append(p.ServiceToRegion[prefix.Service], prefix.Region)
-	return
+	if group := prefix.NetworkBorderGroup; group != "" {
+		p.BorderGroupToService[group] = append(p.BorderGroupToService[group], prefix.Service)
+		p.ServiceToBorderGroup[prefix.Service] = append(p.ServiceToBorderGroup[prefix.Service], group)
+	}
+}
+
+func (p *Prefixes) sortLookups() {
+	for _, lookup := range []map[string][]string{p.RegionToService, p.ServiceToRegion, p.BorderGroupToService, p.ServiceToBorderGroup} {
+		for k := range lookup {
+			lookup[k] = deduplicateStrings(lookup[k])
+			sort.Strings(lookup[k])
+		}
+	}
 }
 
 func (p *Prefixes) UnmarshalJSON(b []byte) error {
@@ -89,7 +138,7 @@ func (p *Prefixes) UnmarshalJSON(b []byte) error {
 					if err != nil {
 						return err
 					}
-					p.PrefixList = append(p.PrefixList, prefix)
+					p.addPrefix(prefix)
 				}
 			}
 			dec.Token() // discard the ]
@@ -98,32 +147,63 @@ func (p *Prefixes) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Filter returns the prefixes picked by the selections, in the order they
+// were selected. Prefixes matching a negated selection are left out no
+// matter where it appears and invalid selections are ignored.
 func (p *Prefixes) Filter(with []string) []Prefix {
+	prefixes, _ := p.FilterSelectors(with)
+	return prefixes
+}
+
+// FilterSelectors is Filter that also returns the selector that picked
+// each of the prefixes
+func (p *Prefixes) FilterSelectors(with []string) ([]Prefix, []*Selector) {
 	p.Cache.m.Lock()
 	defer p.Cache.m.Unlock()
 	if p.Cache.Equals(with) {
-		return p.Cache.Prefixes
+		return p.Cache.Prefixes, p.Cache.Selectors
+	}
+
+	var include, exclude []*Selector
+	for _, v := range with {
+		sel, err := ParseSelector(v)
+		if err != nil {
+			continue
+		}
+		if sel.Negate {
+			exclude = append(exclude, sel)
+		} else {
+			include = append(include, sel)
+		}
+	}
+
+	excluded := func(prefix Prefix) bool {
+		for _, sel := range exclude {
+			if sel.Match(prefix) {
+				return true
+			}
+		}
+		return false
 	}
 
 	wanted := map[*net.IPNet]struct{}{}
 	p.Cache.Prefixes = []Prefix{}
-	for _, v := range with {
-		sp := strings.Split(v, ":")
+	p.Cache.Selectors = []*Selector{}
+	for _, sel := range include {
 		for _, prefix := range p.PrefixList {
 			if _, got := wanted[prefix.Prefix]; got {
 				continue
 			}
 
-			want := sp[0] == "*" || sp[0] == prefix.Region
-			want = want && sp[1] == "*" || sp[1] == prefix.Service
-
-			if want {
+			if sel.Match(prefix) && !excluded(prefix) {
 				wanted[prefix.Prefix] = struct{}{}
 				p.Cache.Prefixes = append(p.Cache.Prefixes, prefix)
+				p.Cache.Selectors = append(p.Cache.Selectors, sel)
 			}
 		}
 	}
-	return p.Cache.Prefixes
+	p.Cache.Filter = append([]string{}, with...)
+	return p.Cache.Prefixes, p.Cache.Selectors
 }
 
 func deduplicateStrings(a []string) []string {
@@ -140,10 +220,7 @@ func deduplicateStrings(a []string) []string {
 }
 
 func ParseAWSIPRanges(ipv6 bool, r io.Reader) (*Prefixes, error) {
-	prefixes := Prefixes{
-		RegionToService: map[string][]string{},
-		ServiceToRegion: map[string][]string{},
-	}
+	prefixes := newPrefixes()
 	dec := json.NewDecoder(r)
 	for dec.More() {
 		tok, err := dec.Token()
@@ -151,8 +228,30 @@ func ParseAWSIPRanges(ipv6 bool, r io.Reader) (*Prefixes, error) {
 			return nil, err
 		}
 
-		if s, isa := tok.(string); isa && (s == "prefixes" || (s == "ipv6_prefixes" && ipv6)) {
-			if err := dec.Decode(&prefixes); err != nil {
+		s, isa := tok.(string)
+		if !isa {
+			continue
+		}
+
+		switch {
+		case s == "syncToken":
+			var token string
+			if err := dec.Decode(&token); err != nil {
+				return nil, err
+			}
+			if prefixes.SyncToken, err = strconv.ParseInt(token, 10, 64); err != nil {
+				return nil, err
+			}
+		case s == "createDate":
+			var date string
+			if err := dec.Decode(&date); err != nil {
+				return nil, err
+			}
+			if prefixes.CreateDate, err = time.Parse(createDateLayout, date); err != nil {
+				return nil, err
+			}
+		case s == "prefixes" || (s == "ipv6_prefixes" && ipv6):
+			if err := dec.Decode(prefixes); err != nil {
 				return nil, err
 			}
 		}
@@ -163,20 +262,11 @@ func ParseAWSIPRanges(ipv6 bool, r io.Reader) (*Prefixes, error) {
 		io.Copy(ioutil.Discard, r)
 	}
 
-	for region := range prefixes.RegionToService {
-		prefixes.RegionToService[region] = deduplicateStrings(prefixes.RegionToService[region])
-		sort.Strings(prefixes.RegionToService[region])
-	}
-
-	for service := range prefixes.ServiceToRegion {
-		prefixes.ServiceToRegion[service] = deduplicateStrings(prefixes.ServiceToRegion[service])
-		sort.Strings(prefixes.ServiceToRegion[service])
-	}
-
-	return &prefixes, nil
+	prefixes.sortLookups()
+	return prefixes, nil
 }
 
-func (a FilteredCache) Equals(b []string) bool {
+func (a *FilteredCache) Equals(b []string) bool {
 	if a.Filter == nil && b == nil {
 		return true
 	}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var sampleJson = `{
@@ -15,11 +16,13 @@ var sampleJson = `{
 		{
 			"ip_prefix": "18.208.0.0/13",
 			"region": "us-east-1",
+			"network_border_group": "us-east-1",
 			"service": "AMAZON"
 		},
 		{
 			"ip_prefix": "52.95.245.0/24",
 			"region": "us-east-1",
+			"network_border_group": "us-east-1-bos-1",
 			"service": "AMAZON"
 		}
 	],
@@ -27,11 +30,13 @@ var sampleJson = `{
 		{
 			"ipv6_prefix": "2600:1f18::/33",
 			"region": "us-east-1",
+			"network_border_group": "us-east-1",
 			"service": "EC2"
 		},
 		{
 			"ipv6_prefix": "2600:1fff:5000::/40",
 			"region": "us-gov-east-1",
+			"network_border_group": "us-gov-east-1",
 			"service": "EC2"
 		}
 	]
@@ -39,12 +44,16 @@ var sampleJson = `{
 
 func TestParseAWSIPRanges(t *testing.T) {
 	expect := &Prefixes{
+		SyncToken:  1531345951,
+		CreateDate: time.Date(2018, 7, 11, 21, 52, 31, 0, time.UTC),
 		PrefixList: []Prefix{
-			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x12, 0xd0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xf8, 0x0, 0x0}}, Region: "us-east-1", Service: "AMAZON"},
-			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x34, 0x5f, 0xf5, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}, Region: "us-east-1", Service: "AMAZON"},
+			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x12, 0xd0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xf8, 0x0, 0x0}}, Region: "us-east-1", NetworkBorderGroup: "us-east-1", Service: "AMAZON"},
+			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x34, 0x5f, 0xf5, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}, Region: "us-east-1", NetworkBorderGroup: "us-east-1-bos-1", Service: "AMAZON"},
 		},
-		RegionToService: map[string][]string{"us-east-1": {"AMAZON"}},
-		ServiceToRegion: map[string][]string{"AMAZON": {"us-east-1"}},
+		RegionToService:      map[string][]string{"us-east-1": {"AMAZON"}},
+		ServiceToRegion:      map[string][]string{"AMAZON": {"us-east-1"}},
+		BorderGroupToService: map[string][]string{"us-east-1": {"AMAZON"}, "us-east-1-bos-1": {"AMAZON"}},
+		ServiceToBorderGroup: map[string][]string{"AMAZON": {"us-east-1", "us-east-1-bos-1"}},
 	}
 
 	r, err := ParseAWSIPRanges(false, strings.NewReader(sampleJson))
@@ -59,14 +68,18 @@ func TestParseAWSIPRanges(t *testing.T) {
 
 func TestParseIPv6AWSIPRanges(t *testing.T) {
 	expect := &Prefixes{
+		SyncToken:  1531345951,
+		CreateDate: time.Date(2018, 7, 11, 21, 52, 31, 0, time.UTC),
 		PrefixList: []Prefix{
-			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x12, 0xd0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xf8, 0x0, 0x0}}, Region: "us-east-1", Service: "AMAZON"},
-			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x34, 0x5f, 0xf5, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}, Region: "us-east-1", Service: "AMAZON"},
-			Prefix{IPv6: true, Prefix: &net.IPNet{IP: net.IP{0x26, 0x0, 0x1f, 0x18, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0xff, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}}, Region: "us-east-1", Service: "EC2"},
-			Prefix{IPv6: true, Prefix: &net.IPNet{IP: net.IP{0x26, 0x0, 0x1f, 0xff, 0x50, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}}, Region: "us-gov-east-1", Service: "EC2"},
+			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x12, 0xd0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xf8, 0x0, 0x0}}, Region: "us-east-1", NetworkBorderGroup: "us-east-1", Service: "AMAZON"},
+			Prefix{IPv6: false, Prefix: &net.IPNet{IP: net.IP{0x34, 0x5f, 0xf5, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0x0}}, Region: "us-east-1", NetworkBorderGroup: "us-east-1-bos-1", Service: "AMAZON"},
+			Prefix{IPv6: true, Prefix: &net.IPNet{IP: net.IP{0x26, 0x0, 0x1f, 0x18, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0xff, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}}, Region: "us-east-1", NetworkBorderGroup: "us-east-1", Service: "EC2"},
+			Prefix{IPv6: true, Prefix: &net.IPNet{IP: net.IP{0x26, 0x0, 0x1f, 0xff, 0x50, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, Mask: net.IPMask{0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}}, Region: "us-gov-east-1", NetworkBorderGroup: "us-gov-east-1", Service: "EC2"},
 		},
-		RegionToService: map[string][]string{"us-east-1": {"AMAZON", "EC2"}, "us-gov-east-1": {"EC2"}},
-		ServiceToRegion: map[string][]string{"EC2": {"us-east-1", "us-gov-east-1"}, "AMAZON": {"us-east-1"}},
+		RegionToService:      map[string][]string{"us-east-1": {"AMAZON", "EC2"}, "us-gov-east-1": {"EC2"}},
+		ServiceToRegion:      map[string][]string{"EC2": {"us-east-1", "us-gov-east-1"}, "AMAZON": {"us-east-1"}},
+		BorderGroupToService: map[string][]string{"us-east-1": {"AMAZON", "EC2"}, "us-east-1-bos-1": {"AMAZON"}, "us-gov-east-1": {"EC2"}},
+		ServiceToBorderGroup: map[string][]string{"EC2": {"us-east-1", "us-gov-east-1"}, "AMAZON": {"us-east-1", "us-east-1-bos-1"}},
 	}
 
 	r, err := ParseAWSIPRanges(true, strings.NewReader(sampleJson))
@@ -95,3 +108,31 @@ func TestParseRealRanges(t *testing.T) {
 		t.Error("No prefixes loaded")
 	}
 }
+
+func TestParseAWSIPRangesBadSyncToken(t *testing.T) {
+	_, err := ParseAWSIPRanges(false, strings.NewReader(`{"syncToken": "yesterday", "prefixes": []}`))
+	if err == nil {
+		t.Error("Expected an error parsing a non numeric syncToken")
+	}
+}
+
+func TestFilterBorderGroup(t *testing.T) {
+	prefixes, err := ParseAWSIPRanges(false, strings.NewReader(sampleJson))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := map[string]int{
+		"us-east-1:*":                 2,
+		"us-east-1@us-east-1:*":       1,
+		"us-east-1@us-east-1-bos-1:*": 1,
+		"@us-east-1-bos-1:AMAZON":     1,
+		"*@us-east-1-bos-1:EC2":       0,
+	}
+
+	for selection, expect := range tests {
+		if got := prefixes.Filter([]string{selection}); len(got) != expect {
+			t.Errorf("Expected %s to select %d prefixes got %d", selection, expect, len(got))
+		}
+	}
+}
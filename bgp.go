@@ -0,0 +1,883 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gct "github.com/freman/go-commontypes"
+)
+
+const defaultBGPPort = 179
+const defaultBGPHoldTime = 90 * time.Second
+
+// bgpMinHoldTime is the shortest hold time a session can have, zero aside
+// which turns keepalives off
+const bgpMinHoldTime = 3 * time.Second
+const bgpRetry = 10 * time.Second
+
+// BGP message types and limits from RFC 4271
+const (
+	bgpOpen         = 1
+	bgpUpdate       = 2
+	bgpNotification = 3
+	bgpKeepalive    = 4
+
+	bgpHeaderLen  = 19
+	bgpMaxMessage = 4096
+	bgpMaxBody    = bgpMaxMessage - bgpHeaderLen
+
+	// bgpASTrans stands in for 4 octet AS numbers in 2 octet fields
+	bgpASTrans = 23456
+)
+
+// BGPConfig is the embedded BGP speaker, it announces the routes to every
+// peer when the bgp sink is enabled. The next hop defaults to the local
+// address of the session, selections can set their own along with
+// communities and local preference, which is only sent to iBGP peers.
+type BGPConfig struct {
+	ASN         uint32
+	RouterID    net.IP
+	NextHop     net.IP
+	NextHop6    net.IP
+	Communities []string
+	LocalPref   int
+	HoldTime    gct.Duration
+	Peers       []BGPPeer
+
+	communities []uint32
+}
+
+// BGPPeer is a router the routes are announced to
+type BGPPeer struct {
+	Address net.IP
+	ASN     uint32
+	Port    int
+}
+
+// BGPPeerStatus is the state of the session with a peer
+type BGPPeerStatus struct {
+	Peer      string
+	State     string
+	Since     time.Time
+	Announced int
+	LastError string `json:",omitempty"`
+}
+
+var wellKnownCommunities = map[string]uint32{
+	"no-export":           0xffffff01,
+	"no-advertise":        0xffffff02,
+	"no-export-subconfed": 0xffffff03,
+	"blackhole":           0xffff029a,
+}
+
+// parseCommunity parses a community written as asn:value or by its well
+// known name
+func parseCommunity(s string) (uint32, error) {
+	if v, found := wellKnownCommunities[s]; found {
+		return v, nil
+	}
+	if parts := strings.Split(s, ":"); len(parts) == 2 {
+		asn, err1 := strconv.ParseUint(parts[0], 10, 16)
+		value, err2 := strconv.ParseUint(parts[1], 10, 16)
+		if err1 == nil && err2 == nil {
+			return uint32(asn<<16 | value), nil
+		}
+	}
+	return 0, fmt.Errorf("bad community %q", s)
+}
+
+func communityString(community uint32) string {
+	for k, v := range wellKnownCommunities {
+		if v == community {
+			return k
+		}
+	}
+	return fmt.Sprintf("%d:%d", community>>16, community&0xffff)
+}
+
+// bgpKey identifies routes announced the same way
+func (r *Route) bgpKey() string {
+	return fmt.Sprintf("%s|%v|%d", r.BGPNextHop, r.Communities, r.LocalPref)
+}
+
+func validateBGP(c *Config) error {
+	c.BGP.communities = nil
+	for _, v := range c.BGP.Communities {
+		community, err := parseCommunity(v)
+		if err != nil {
+			return err
+		}
+		c.BGP.communities = append(c.BGP.communities, community)
+	}
+	if c.BGP.LocalPref < 0 {
+		return fmt.Errorf("bad local_pref %d", c.BGP.LocalPref)
+	}
+	if hold := c.BGP.HoldTime.Duration; hold > 0 && (hold < bgpMinHoldTime || hold > 0xffff*time.Second) {
+		return fmt.Errorf("bad hold_time %s, must be between %s and %s", hold, bgpMinHoldTime, 0xffff*time.Second)
+	}
+
+	if !c.sink("bgp") {
+		return nil
+	}
+	if c.BGP.ASN == 0 {
+		return errors.New("missing asn")
+	}
+	if c.BGP.RouterID.To4() == nil {
+		return errors.New("router_id must be an IPv4 address")
+	}
+	if len(c.BGP.Peers) == 0 {
+		return errors.New("no peers")
+	}
+	for i := range c.BGP.Peers {
+		peer := &c.BGP.Peers[i]
+		if peer.Address == nil || peer.ASN == 0 {
+			return fmt.Errorf("peer %d needs an address and asn", i+1)
+		}
+		if peer.Port == 0 {
+			peer.Port = defaultBGPPort
+		}
+	}
+	return nil
+}
+
+// bgpSink announces the routes from the embedded speaker, which is
+// restarted when the configuration changes. Sessions come up and announce
+// in the background.
+type bgpSink struct {
+	sinkState
+	a *app
+
+	speakerLock sync.Mutex
+	speaker     *bgpSpeaker
+}
+
+// Plan compares the routes with what the established sessions were sent,
+// with none established everything is still to be announced
+func (s *bgpSink) Plan(routes []*Route) (*Plan, error) {
+	s.speakerLock.Lock()
+	defer s.speakerLock.Unlock()
+
+	if s.speaker == nil {
+		return &Plan{Add: announced(routes)}, nil
+	}
+	return s.speaker.plan(routes), nil
+}
+
+func (s *bgpSink) Apply(routes []*Route) error {
+	s.speakerLock.Lock()
+	defer s.speakerLock.Unlock()
+
+	if s.speaker == nil || !reflect.DeepEqual(s.speaker.config, s.a.config.BGP) {
+		if s.speaker != nil {
+			s.speaker.close()
+		}
+		s.speaker = newBGPSpeaker(s.a.config.BGP, s.a.log)
+	}
+	s.speaker.announce(routes)
+	return s.record(routes, nil)
+}
+
+// Close shuts the speaker down when the sink is disabled
+func (s *bgpSink) Close() {
+	s.speakerLock.Lock()
+	defer s.speakerLock.Unlock()
+
+	if s.speaker != nil {
+		s.speaker.close()
+		s.speaker = nil
+	}
+}
+
+// Status is only healthy while a session is established
+func (s *bgpSink) Status() SinkStatus {
+	status := s.sinkState.Status()
+	peers := s.peers()
+
+	established := 0
+	for _, v := range peers {
+		if v.State == "Established" {
+			established++
+		}
+	}
+	status.Detail = fmt.Sprintf("%d of %d peers established", established, len(peers))
+	if established == 0 {
+		status.Healthy = false
+	}
+	return status
+}
+
+func (s *bgpSink) peers() []BGPPeerStatus {
+	s.speakerLock.Lock()
+	defer s.speakerLock.Unlock()
+
+	if s.speaker == nil {
+		return nil
+	}
+	return s.speaker.status()
+}
+
+// bgpStatus returns the state of every session when the speaker is running
+func (a *app) bgpStatus() []BGPPeerStatus {
+	if sink, ok := a.enabledSink("bgp").(*bgpSink); ok {
+		return sink.peers()
+	}
+	return nil
+}
+
+// bgpSpeaker announces the routes to every peer, each session keeps track
+// of what it announced and sends the difference when the routes change
+type bgpSpeaker struct {
+	sync.Mutex
+	config   BGPConfig
+	routes   []*Route
+	sessions []*bgpSession
+	stop     chan struct{}
+	log      *log.Logger
+}
+
+// bgpSession is a peer, what it was sent as of its last sync is kept for
+// planning while it's established
+type bgpSession struct {
+	peer       BGPPeer
+	wake       chan struct{}
+	status     BGPPeerStatus
+	info       bgpPeerInfo
+	advertised map[string]string
+}
+
+func newBGPSpeaker(config BGPConfig, logger *log.Logger) *bgpSpeaker {
+	s := &bgpSpeaker{config: config, stop: make(chan struct{}), log: logger}
+	for _, peer := range config.Peers {
+		session := &bgpSession{peer: peer, wake: make(chan struct{}, 1)}
+		session.status = BGPPeerStatus{Peer: net.JoinHostPort(peer.Address.String(), strconv.Itoa(peer.Port)), State: "Idle", Since: time.Now()}
+		s.sessions = append(s.sessions, session)
+		go s.run(session)
+	}
+	return s
+}
+
+func (s *bgpSpeaker) close() {
+	close(s.stop)
+}
+
+// announced drops all but the first route to each destination, only one
+// of them can be announced
+func announced(routes []*Route) []*Route {
+	seen := make(map[string]struct{}, len(routes))
+	unique := make([]*Route, 0, len(routes))
+	for _, v := range routes {
+		if _, found := seen[v.Dst.String()]; !found {
+			seen[v.Dst.String()] = struct{}{}
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// announce replaces the routes and wakes every session to send the changes
+func (s *bgpSpeaker) announce(routes []*Route) {
+	s.Lock()
+	s.routes = announced(routes)
+	s.Unlock()
+
+	for _, session := range s.sessions {
+		select {
+		case session.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// status returns the state of every session
+func (s *bgpSpeaker) status() []BGPPeerStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	statuses := make([]BGPPeerStatus, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		statuses = append(statuses, session.status)
+	}
+	return statuses
+}
+
+func (s *bgpSpeaker) setState(session *bgpSession, state string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if session.status.State != state {
+		session.status.State, session.status.Since = state, time.Now()
+	}
+	if state != "Established" {
+		session.status.Announced, session.advertised = 0, nil
+	}
+	if err != nil {
+		session.status.LastError = err.Error()
+	}
+}
+
+// run keeps a session with the peer up until the speaker is closed
+func (s *bgpSpeaker) run(session *bgpSession) {
+	for {
+		err := s.session(session)
+		s.setState(session, "Idle", err)
+		if err != nil {
+			s.log.Println("BGP session with", session.status.Peer, "failed due to", err)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(bgpRetry):
+		}
+	}
+}
+
+// bgpPeerInfo is what was learnt about the peer when the session came up,
+// only the unicast families it negotiated are announced to it
+type bgpPeerInfo struct {
+	ebgp  bool
+	as4   bool
+	ipv4  bool
+	ipv6  bool
+	local net.IP
+}
+
+func (s *bgpSpeaker) session(session *bgpSession) error {
+	s.setState(session, "Connect", nil)
+	conn, err := net.DialTimeout("tcp", session.status.Peer, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	holdTime := s.config.HoldTime.Duration
+	if holdTime <= 0 {
+		holdTime = defaultBGPHoldTime
+	}
+
+	s.setState(session, "OpenSent", nil)
+	if err := writeBGP(conn, bgpOpen, s.openMessage(holdTime)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(holdTime))
+	msgType, body, err := readBGP(conn)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpOpen {
+		return unexpectedBGP(msgType, body)
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		return err
+	}
+	if open.asn != session.peer.ASN {
+		// Bad Peer AS
+		writeBGP(conn, bgpNotification, []byte{2, 2})
+		return fmt.Errorf("peer is AS%d, expected AS%d", open.asn, session.peer.ASN)
+	}
+	if open.holdTime > 0 && open.holdTime < bgpMinHoldTime {
+		// Unacceptable Hold Time
+		writeBGP(conn, bgpNotification, []byte{2, 6})
+		return fmt.Errorf("peer hold time of %s is too short", open.holdTime)
+	}
+	if open.holdTime < holdTime {
+		holdTime = open.holdTime
+	}
+
+	if err := writeBGP(conn, bgpKeepalive, nil); err != nil {
+		return err
+	}
+	s.setState(session, "OpenConfirm", nil)
+	conn.SetReadDeadline(time.Now().Add(holdTime))
+	if err := openConfirm(conn); err != nil {
+		return err
+	}
+
+	peer := bgpPeerInfo{ebgp: open.asn != s.config.ASN, as4: open.as4, ipv4: open.ipv4, ipv6: open.ipv6, local: conn.LocalAddr().(*net.TCPAddr).IP}
+	s.setState(session, "Established", nil)
+	s.log.Println("BGP session with", session.status.Peer, "established")
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				conn.SetReadDeadline(time.Now().Add(holdTime))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			msgType, body, err := readBGP(conn)
+			switch {
+			case err != nil:
+			case msgType == bgpNotification:
+				err = unexpectedBGP(msgType, body)
+			case msgType != bgpKeepalive && msgType != bgpUpdate:
+				err = unexpectedBGP(msgType, body)
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	advertised := map[string]string{}
+	if err := s.sync(conn, session, peer, advertised); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-session.wake:
+			if err := s.sync(conn, session, peer, advertised); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if err := writeBGP(conn, bgpKeepalive, nil); err != nil {
+				return err
+			}
+		case err := <-received:
+			return err
+		case <-s.stop:
+			// Cease, administrative shutdown
+			writeBGP(conn, bgpNotification, []byte{6, 2})
+			return nil
+		}
+	}
+}
+
+// bgpAnnouncement is a group of prefixes announced with the same attributes
+type bgpAnnouncement struct {
+	ipv6     bool
+	nextHop  net.IP
+	attrs    []byte
+	prefixes []*net.IPNet
+}
+
+// sync sends the peer whatever changed since the last sync, advertised is
+// what the peer has been sent so far
+func (s *bgpSpeaker) sync(w io.Writer, session *bgpSession, peer bgpPeerInfo, advertised map[string]string) error {
+	s.Lock()
+	routes := s.routes
+	s.Unlock()
+
+	wanted := make(map[string]struct{}, len(routes))
+	announcements := map[string]*bgpAnnouncement{}
+	skipped, unsupported := 0, 0
+	for _, v := range routes {
+		ipv6 := v.Dst.IP.To4() == nil
+		if ipv6 && !peer.ipv6 || !ipv6 && !peer.ipv4 {
+			unsupported++
+			continue
+		}
+		nextHop := s.nextHop(v, peer.local)
+		if nextHop == nil {
+			skipped++
+			continue
+		}
+
+		attrs := s.pathAttributes(v, peer)
+		key := string(attrs) + nextHop.String()
+		dst := v.Dst.String()
+		wanted[dst] = struct{}{}
+		if advertised[dst] == key {
+			continue
+		}
+		advertised[dst] = key
+
+		if announcements[key] == nil {
+			announcements[key] = &bgpAnnouncement{ipv6: ipv6, nextHop: nextHop, attrs: attrs}
+		}
+		announcements[key].prefixes = append(announcements[key].prefixes, v.Dst)
+	}
+	if skipped > 0 {
+		s.log.Println("Not announcing", skipped, "prefixes to", session.status.Peer, "without a next hop of their family")
+	}
+	if unsupported > 0 {
+		s.log.Println("Not announcing", unsupported, "prefixes to", session.status.Peer, "in a family it didn't negotiate")
+	}
+
+	var withdraw4, withdraw6 []*net.IPNet
+	for dst := range advertised {
+		if _, found := wanted[dst]; !found {
+			_, network, _ := net.ParseCIDR(dst)
+			if network.IP.To4() != nil {
+				withdraw4 = append(withdraw4, network)
+			} else {
+				withdraw6 = append(withdraw6, network)
+			}
+			delete(advertised, dst)
+		}
+	}
+
+	keys := make([]string, 0, len(announcements))
+	for k := range announcements {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var updates [][]byte
+	updates = append(updates, withdrawUpdates(withdraw4, withdraw6)...)
+	for _, k := range keys {
+		updates = append(updates, announcements[k].updates()...)
+	}
+	for _, v := range updates {
+		if err := writeBGP(w, bgpUpdate, v); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	session.status.Announced, session.info = len(advertised), peer
+	session.advertised = make(map[string]string, len(advertised))
+	for k, v := range advertised {
+		session.advertised[k] = v
+	}
+	s.Unlock()
+	return nil
+}
+
+// plan works out what announcing the routes would change on the
+// established sessions, a route announced with different attributes is
+// withdrawn and added
+func (s *bgpSpeaker) plan(routes []*Route) *Plan {
+	s.Lock()
+	defer s.Unlock()
+
+	plan := &Plan{}
+	wanted := map[string]struct{}{}
+	for _, v := range announced(routes) {
+		dst := v.Dst.String()
+		wanted[dst] = struct{}{}
+
+		add, changed := false, false
+		for _, session := range s.sessions {
+			if session.advertised == nil {
+				continue
+			}
+			ipv6 := v.Dst.IP.To4() == nil
+			if ipv6 && !session.info.ipv6 || !ipv6 && !session.info.ipv4 {
+				continue
+			}
+			nextHop := s.nextHop(v, session.info.local)
+			if nextHop == nil {
+				continue
+			}
+			key, found := session.advertised[dst]
+			if key != string(s.pathAttributes(v, session.info))+nextHop.String() {
+				add, changed = true, changed || found
+			}
+		}
+		if changed {
+			plan.Remove = append(plan.Remove, &Route{Dst: v.Dst})
+		}
+		if add || !s.established() {
+			plan.Add = append(plan.Add, v)
+		} else {
+			plan.Unchanged++
+		}
+	}
+
+	removed := map[string]struct{}{}
+	for _, session := range s.sessions {
+		for dst := range session.advertised {
+			if _, found := wanted[dst]; found {
+				continue
+			}
+			if _, found := removed[dst]; !found {
+				removed[dst] = struct{}{}
+				_, network, _ := net.ParseCIDR(dst)
+				plan.Remove = append(plan.Remove, &Route{Dst: network})
+			}
+		}
+	}
+	return plan
+}
+
+// established reports if any session is established, the speaker must be
+// locked
+func (s *bgpSpeaker) established() bool {
+	for _, session := range s.sessions {
+		if session.advertised != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// nextHop is the selection's next hop, then the configured one, then the
+// local address of the session when it's the same family as the route
+func (s *bgpSpeaker) nextHop(r *Route, local net.IP) net.IP {
+	ipv6 := r.Dst.IP.To4() == nil
+	nextHop := r.BGPNextHop
+	if nextHop == nil {
+		if nextHop = s.config.NextHop; ipv6 {
+			nextHop = s.config.NextHop6
+		}
+	}
+	if nextHop == nil && (local.To4() == nil) == ipv6 {
+		nextHop = local
+	}
+	if ipv6 {
+		return nextHop.To16()
+	}
+	return nextHop.To4()
+}
+
+// pathAttributes encodes everything but the next hop and prefixes
+func (s *bgpSpeaker) pathAttributes(r *Route, peer bgpPeerInfo) []byte {
+	// ORIGIN IGP
+	attrs := bgpAttribute(0x40, 1, []byte{0})
+
+	var path []byte
+	if peer.ebgp {
+		// A single AS_SEQUENCE of our AS
+		path = []byte{2, 1}
+		if peer.as4 {
+			path = appendUint32(path, s.config.ASN)
+		} else if s.config.ASN > 0xffff {
+			path = appendUint16(path, bgpASTrans)
+		} else {
+			path = appendUint16(path, uint16(s.config.ASN))
+		}
+	}
+	attrs = append(attrs, bgpAttribute(0x40, 2, path)...)
+
+	if !peer.ebgp {
+		localPref := r.LocalPref
+		if localPref == 0 {
+			localPref = 100
+		}
+		attrs = append(attrs, bgpAttribute(0x40, 5, appendUint32(nil, uint32(localPref)))...)
+	}
+
+	if len(r.Communities) > 0 {
+		var communities []byte
+		for _, v := range r.Communities {
+			communities = appendUint32(communities, v)
+		}
+		attrs = append(attrs, bgpAttribute(0xc0, 8, communities)...)
+	}
+
+	if peer.ebgp && !peer.as4 && s.config.ASN > 0xffff {
+		// AS4_PATH carries the real AS past AS_TRANS for anyone downstream
+		// that does speak 4-byte AS numbers
+		attrs = append(attrs, bgpAttribute(0xc0, 17, appendUint32([]byte{2, 1}, s.config.ASN))...)
+	}
+	return attrs
+}
+
+// updates encodes the announcement into as many updates as it takes
+func (a *bgpAnnouncement) updates() [][]byte {
+	var updates [][]byte
+	if !a.ipv6 {
+		attrs := append(append([]byte{}, a.attrs...), bgpAttribute(0x40, 3, a.nextHop)...)
+		for _, nlri := range packPrefixes(a.prefixes, bgpMaxBody-4-len(attrs)) {
+			updates = append(updates, updateMessage(nil, attrs, nlri))
+		}
+		return updates
+	}
+
+	// MP_REACH_NLRI for IPv6 unicast, 25 bytes before the prefixes
+	for _, nlri := range packPrefixes(a.prefixes, bgpMaxBody-4-len(a.attrs)-25) {
+		reach := append([]byte{0, 2, 1, 16}, a.nextHop...)
+		reach = append(append(reach, 0), nlri...)
+		updates = append(updates, updateMessage(nil, append(append([]byte{}, a.attrs...), bgpAttribute(0x80, 14, reach)...), nil))
+	}
+	return updates
+}
+
+// withdrawUpdates encodes withdrawals into as many updates as it takes
+func withdrawUpdates(ipv4, ipv6 []*net.IPNet) [][]byte {
+	var updates [][]byte
+	for _, withdrawn := range packPrefixes(ipv4, bgpMaxBody-4) {
+		updates = append(updates, updateMessage(withdrawn, nil, nil))
+	}
+	// MP_UNREACH_NLRI for IPv6 unicast, 7 bytes before the prefixes
+	for _, withdrawn := range packPrefixes(ipv6, bgpMaxBody-4-7) {
+		updates = append(updates, updateMessage(nil, bgpAttribute(0x80, 15, append([]byte{0, 2, 1}, withdrawn...)), nil))
+	}
+	return updates
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func updateMessage(withdrawn, attrs, nlri []byte) []byte {
+	msg := appendUint16(nil, uint16(len(withdrawn)))
+	msg = append(msg, withdrawn...)
+	msg = appendUint16(msg, uint16(len(attrs)))
+	msg = append(msg, attrs...)
+	return append(msg, nlri...)
+}
+
+// bgpAttribute encodes a path attribute, using an extended length when the
+// value needs it
+func bgpAttribute(flags, code byte, value []byte) []byte {
+	if len(value) > 0xff {
+		return append(appendUint16([]byte{flags | 0x10, code}, uint16(len(value))), value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
+// packPrefixes encodes prefixes as length and significant octets, split
+// into runs that fit in room
+func packPrefixes(prefixes []*net.IPNet, room int) [][]byte {
+	var packed [][]byte
+	var current []byte
+	for _, v := range prefixes {
+		ip := v.IP.To4()
+		if ip == nil {
+			ip = v.IP.To16()
+		}
+		ones, _ := v.Mask.Size()
+		prefix := append([]byte{byte(ones)}, ip[:(ones+7)/8]...)
+		if len(current)+len(prefix) > room {
+			packed = append(packed, current)
+			current = nil
+		}
+		current = append(current, prefix...)
+	}
+	if len(current) > 0 {
+		packed = append(packed, current)
+	}
+	return packed
+}
+
+func (s *bgpSpeaker) openMessage(holdTime time.Duration) []byte {
+	asn := uint16(bgpASTrans)
+	if s.config.ASN <= 0xffff {
+		asn = uint16(s.config.ASN)
+	}
+
+	// Multiprotocol IPv4 and IPv6 unicast and 4 octet AS numbers
+	caps := []byte{1, 4, 0, 1, 0, 1, 1, 4, 0, 2, 0, 1, 65, 4}
+	caps = appendUint32(caps, s.config.ASN)
+
+	msg := appendUint16([]byte{4}, asn)
+	msg = appendUint16(msg, uint16(holdTime/time.Second))
+	msg = append(msg, s.config.RouterID.To4()...)
+	msg = append(msg, byte(len(caps)+2), 2, byte(len(caps)))
+	return append(msg, caps...)
+}
+
+// bgpOpenMessage is what a peer's OPEN tells us, a peer that doesn't
+// advertise any multiprotocol capabilities only does IPv4 unicast
+type bgpOpenMessage struct {
+	asn      uint32
+	as4      bool
+	ipv4     bool
+	ipv6     bool
+	holdTime time.Duration
+}
+
+func parseOpen(body []byte) (open bgpOpenMessage, err error) {
+	if len(body) < 10 || body[0] != 4 || int(body[9]) != len(body)-10 {
+		return open, errors.New("malformed open message")
+	}
+	open.asn = uint32(binary.BigEndian.Uint16(body[1:]))
+	open.holdTime = time.Duration(binary.BigEndian.Uint16(body[3:])) * time.Second
+
+	multiprotocol := false
+
+	for params := body[10:]; len(params) >= 2; params = params[2+int(params[1]):] {
+		if len(params) < 2+int(params[1]) {
+			return open, errors.New("malformed open message parameters")
+		}
+		if params[0] != 2 {
+			continue
+		}
+		for caps := params[2 : 2+int(params[1])]; len(caps) >= 2 && len(caps) >= 2+int(caps[1]); caps = caps[2+int(caps[1]):] {
+			switch {
+			case caps[0] == 65 && caps[1] == 4:
+				open.asn, open.as4 = binary.BigEndian.Uint32(caps[2:]), true
+			case caps[0] == 1 && caps[1] == 4:
+				multiprotocol = true
+				// AFI 1 or 2, SAFI 1 is unicast
+				if afi := binary.BigEndian.Uint16(caps[2:]); caps[5] == 1 {
+					open.ipv4 = open.ipv4 || afi == 1
+					open.ipv6 = open.ipv6 || afi == 2
+				}
+			}
+		}
+	}
+	if !multiprotocol {
+		open.ipv4 = true
+	}
+	return open, nil
+}
+
+// openConfirm waits for the peer to accept our OPEN with a KEEPALIVE
+func openConfirm(r io.Reader) error {
+	msgType, body, err := readBGP(r)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpKeepalive {
+		return unexpectedBGP(msgType, body)
+	}
+	return nil
+}
+
+// unexpectedBGP describes a notification or a message that shouldn't have
+// been sent
+func unexpectedBGP(msgType byte, body []byte) error {
+	if msgType == bgpNotification && len(body) >= 2 {
+		return fmt.Errorf("peer sent notification %d/%d", body[0], body[1])
+	}
+	return fmt.Errorf("unexpected message type %d", msgType)
+}
+
+func writeBGP(w io.Writer, msgType byte, body []byte) error {
+	msg := make([]byte, bgpHeaderLen, bgpHeaderLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(bgpHeaderLen+len(body)))
+	msg[18] = msgType
+
+	if conn, ok := w.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	}
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+func readBGP(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, bgpHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < bgpHeaderLen || length > bgpMaxMessage {
+		return 0, nil, fmt.Errorf("bad message length %d", length)
+	}
+
+	body := make([]byte, length-bgpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOpen(t *testing.T) {
+	s := &bgpSpeaker{config: BGPConfig{ASN: 4200000001, RouterID: net.ParseIP("10.0.0.1")}}
+	open, err := parseOpen(s.openMessage(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (bgpOpenMessage{asn: 4200000001, as4: true, ipv4: true, ipv6: true, holdTime: 90 * time.Second}); open != expect {
+		t.Errorf("Expected %+v got %+v", expect, open)
+	}
+
+	// IPv6 unicast only, then no capabilities at all
+	for body, expect := range map[string]bgpOpenMessage{
+		string([]byte{4, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 8, 2, 6, 1, 4, 0, 2, 0, 1}): {asn: 65001, ipv6: true, holdTime: 90 * time.Second},
+		string([]byte{4, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 0}):                         {asn: 65001, ipv4: true, holdTime: 90 * time.Second},
+	} {
+		if open, err := parseOpen([]byte(body)); err != nil || open != expect {
+			t.Errorf("Expected %+v got %+v, %v", expect, open, err)
+		}
+	}
+
+	for _, body := range [][]byte{nil, {4, 0, 1, 0, 90, 10, 0, 0, 1, 3, 2, 4}} {
+		if _, err := parseOpen(body); err == nil {
+			t.Errorf("Expected an error for %v", body)
+		}
+	}
+}
+
+func TestBGPSync(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	s := &bgpSpeaker{config: BGPConfig{ASN: 65000, NextHop6: net.ParseIP("fd00::1")}, log: log.New(ioutil.Discard, "", 0)}
+	session := &bgpSession{}
+	peer := bgpPeerInfo{ebgp: true, as4: true, ipv4: true, ipv6: true, local: net.ParseIP("10.0.0.1").To4()}
+	advertised := map[string]string{}
+
+	updates := func() [][]byte {
+		var buf bytes.Buffer
+		if err := s.sync(&buf, session, peer, advertised); err != nil {
+			t.Fatal(err)
+		}
+		var updates [][]byte
+		for buf.Len() > 0 {
+			msgType, body, err := readBGP(&buf)
+			if err != nil || msgType != bgpUpdate {
+				t.Fatalf("Bad update %d %v", msgType, err)
+			}
+			updates = append(updates, body)
+		}
+		return updates
+	}
+
+	s.announce([]*Route{
+		{Dst: network("52.94.0.0/23"), Communities: []uint32{65000<<16 | 100}},
+		{Dst: network("2600:1f18::/32")},
+	})
+	expect := [][]byte{
+		{0, 0, 0, 42, 0x40, 1, 1, 0, 0x40, 2, 6, 2, 1, 0, 0, 0xfd, 0xe8, 0x80, 14, 26, 0, 2, 1, 16, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 32, 0x26, 0, 0x1f, 0x18},
+		{0, 0, 0, 27, 0x40, 1, 1, 0, 0x40, 2, 6, 2, 1, 0, 0, 0xfd, 0xe8, 0xc0, 8, 4, 0xfd, 0xe8, 0, 100, 0x40, 3, 4, 10, 0, 0, 1, 23, 52, 94, 0},
+	}
+	if got := updates(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected announcements %v got %v", expect, got)
+	}
+
+	if got := updates(); len(got) != 0 {
+		t.Errorf("Expected nothing to change got %v", got)
+	}
+
+	s.announce([]*Route{{Dst: network("2600:1f18::/32")}})
+	expect = [][]byte{{0, 4, 23, 52, 94, 0, 0, 0}}
+	if got := updates(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected withdrawal %v got %v", expect, got)
+	}
+	if session.status.Announced != 1 {
+		t.Errorf("Expected 1 announced prefix got %d", session.status.Announced)
+	}
+}
+
+func TestPathAttributesAS4Path(t *testing.T) {
+	s := &bgpSpeaker{config: BGPConfig{ASN: 4200000001}}
+
+	// A 2-byte peer sees AS_TRANS with the real AS in AS4_PATH
+	expect := []byte{0x40, 1, 1, 0, 0x40, 2, 4, 2, 1, 0x5b, 0xa0, 0xc0, 17, 6, 2, 1, 0xfa, 0x56, 0xea, 0x01}
+	if got := s.pathAttributes(&Route{}, bgpPeerInfo{ebgp: true}); !bytes.Equal(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+
+	expect = []byte{0x40, 1, 1, 0, 0x40, 2, 6, 2, 1, 0xfa, 0x56, 0xea, 0x01}
+	if got := s.pathAttributes(&Route{}, bgpPeerInfo{ebgp: true, as4: true}); !bytes.Equal(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+}
+
+func TestSessionHoldTime(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	notification := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readBGP(conn)
+		writeBGP(conn, bgpOpen, []byte{4, 0xfd, 0xe9, 0, 2, 10, 0, 0, 2, 0})
+		if msgType, body, err := readBGP(conn); err == nil && msgType == bgpNotification {
+			notification <- body
+		}
+		close(notification)
+	}()
+
+	s := &bgpSpeaker{config: BGPConfig{ASN: 65000, RouterID: net.ParseIP("10.0.0.1")}, log: log.New(ioutil.Discard, "", 0)}
+	session := &bgpSession{peer: BGPPeer{ASN: 65001}, status: BGPPeerStatus{Peer: l.Addr().String()}}
+	if err := s.session(session); err == nil {
+		t.Error("Expected a 2 second hold time to be refused")
+	}
+	if body := <-notification; !bytes.Equal(body, []byte{2, 6}) {
+		t.Errorf("Expected an unacceptable hold time notification got %v", body)
+	}
+}
+
+func TestBGPSyncFamilies(t *testing.T) {
+	_, dst4, _ := net.ParseCIDR("52.94.0.0/23")
+	_, dst6, _ := net.ParseCIDR("2600:1f18::/32")
+
+	s := &bgpSpeaker{config: BGPConfig{ASN: 65000, NextHop6: net.ParseIP("fd00::1")}, log: log.New(ioutil.Discard, "", 0)}
+	s.announce([]*Route{{Dst: dst4}, {Dst: dst6}})
+
+	var buf bytes.Buffer
+	advertised := map[string]string{}
+	peer := bgpPeerInfo{ipv4: true, local: net.ParseIP("10.0.0.1").To4()}
+	if err := s.sync(&buf, &bgpSession{}, peer, advertised); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := advertised[dst6.String()]; found || len(advertised) != 1 {
+		t.Errorf("Expected only IPv4 to be announced got %v", advertised)
+	}
+}
+
+func TestOpenConfirm(t *testing.T) {
+	var buf bytes.Buffer
+	writeBGP(&buf, bgpKeepalive, nil)
+	if err := openConfirm(&buf); err != nil {
+		t.Errorf("Expected a keepalive to confirm the session got %v", err)
+	}
+
+	writeBGP(&buf, bgpNotification, []byte{2, 2})
+	if err := openConfirm(&buf); err == nil {
+		t.Error("Expected a notification to fail the session")
+	}
+
+	writeBGP(&buf, bgpUpdate, updateMessage(nil, nil, nil))
+	if err := openConfirm(&buf); err == nil {
+		t.Error("Expected an update before the keepalive to fail the session")
+	}
+}
+
+func TestBGPPlan(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	s := &bgpSpeaker{config: BGPConfig{ASN: 65000}, log: log.New(ioutil.Discard, "", 0)}
+	routes := []*Route{{Dst: network("52.94.0.0/23")}, {Dst: network("52.94.4.0/24")}}
+	if plan := s.plan(routes); len(plan.Add) != 2 {
+		t.Errorf("Expected everything to be added without a session got %+v", plan)
+	}
+
+	session := &bgpSession{status: BGPPeerStatus{State: "Established"}}
+	s.sessions = []*bgpSession{session}
+	s.announce(routes)
+	peer := bgpPeerInfo{ebgp: true, ipv4: true, local: net.ParseIP("10.0.0.1").To4()}
+	if err := s.sync(ioutil.Discard, session, peer, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	planned := []*Route{
+		{Dst: network("52.94.0.0/23")},
+		{Dst: network("52.94.4.0/24"), Communities: []uint32{65000<<16 | 100}},
+		{Dst: network("52.94.8.0/24")},
+	}
+	plan := s.plan(planned)
+	var added, removed []string
+	for _, v := range plan.Add {
+		added = append(added, v.Dst.String())
+	}
+	for _, v := range plan.Remove {
+		removed = append(removed, v.Dst.String())
+	}
+	if expect := []string{"52.94.4.0/24", "52.94.8.0/24"}; !reflect.DeepEqual(added, expect) {
+		t.Errorf("Expected to add %v got %v", expect, added)
+	}
+	if expect := []string{"52.94.4.0/24"}; !reflect.DeepEqual(removed, expect) {
+		t.Errorf("Expected to remove %v got %v", expect, removed)
+	}
+	if plan.Unchanged != 1 {
+		t.Errorf("Expected 1 unchanged got %d", plan.Unchanged)
+	}
+
+	if plan := s.plan(planned[:1]); len(plan.Remove) != 1 || plan.Remove[0].Dst.String() != "52.94.4.0/24" {
+		t.Errorf("Expected the dropped route to be withdrawn got %+v", plan)
+	}
+}
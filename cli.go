@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a subcommand that talks to a running daemon
+type command struct {
+	usage string
+	run   func(cfg *Config, args []string) error
+}
+
+var commands = map[string]command{
+	"export": {"export <format> [via <gateway>]... [table <table>] [name <name>]", exportCommand},
+	"lookup": {"lookup <ip>", lookupCommand},
+	"plan":   {"plan", planCommand},
+	"rules":  {"rules [remove]", rulesCommand},
+}
+
+func runCommand(cfg *Config, args []string) error {
+	cmd, found := commands[args[0]]
+	if !found {
+		var usage []string
+		for _, v := range commands {
+			usage = append(usage, v.usage)
+		}
+		return fmt.Errorf("unknown command %q, expected one of: %s", args[0], strings.Join(usage, ", "))
+	}
+	return cmd.run(cfg, args[1:])
+}
+
+// apiGet makes a request to the api of the daemon using the configuration
+func apiGet(cfg *Config, endpoint string, query url.Values, into interface{}) error {
+	return apiDo(cfg, http.MethodGet, endpoint, query, into)
+}
+
+func apiDo(cfg *Config, method, endpoint string, query url.Values, into interface{}) error {
+	host, port, _ := net.SplitHostPort(cfg.Listen)
+	if host == "" {
+		host = "localhost"
+	}
+
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/api/v1/" + endpoint, RawQuery: query.Encode()}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	if w, ok := into.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+func lookupCommand(cfg *Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lookup <ip>")
+	}
+
+	var result LookupResult
+	if err := apiGet(cfg, "lookup", url.Values{"ip": {args[0]}}, &result); err != nil {
+		return err
+	}
+
+	if len(result.Matches) == 0 {
+		fmt.Println(result.IP, "is not in any known prefix")
+	}
+	for _, v := range result.Matches {
+		line := []string{v.Prefix}
+		if v.Custom {
+			line = append(line, "custom")
+		} else {
+			line = append(line, v.Provider, v.Region, v.Service)
+			if v.NetworkBorderGroup != "" && v.NetworkBorderGroup != v.Region {
+				line = append(line, "("+v.NetworkBorderGroup+")")
+			}
+			if v.Selection != "" {
+				line = append(line, "selected by", v.Selection)
+			}
+		}
+		fmt.Println(strings.Join(line, " "))
+	}
+
+	if result.Route != "" {
+		fmt.Println(result.IP, "is routed via", result.Route)
+	} else {
+		fmt.Println(result.IP, "is not routed")
+	}
+	return nil
+}
+
+func exportCommand(cfg *Config, args []string) error {
+	usage := errors.New("usage: export <format> [via <gateway>]... [table <table>] [name <name>]")
+	if len(args) == 0 || len(args)%2 != 1 {
+		return usage
+	}
+
+	query := url.Values{}
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "via":
+			ip := net.ParseIP(args[i+1])
+			if ip == nil {
+				return fmt.Errorf("invalid gateway %q", args[i+1])
+			}
+			if ip.To4() != nil {
+				query.Set("gateway", ip.String())
+			} else {
+				query.Set("gateway6", ip.String())
+			}
+		case "table", "name":
+			query.Set(args[i], args[i+1])
+		default:
+			return usage
+		}
+	}
+
+	return apiGet(cfg, "export/"+args[0], query, os.Stdout)
+}
+
+func planCommand(cfg *Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: plan")
+	}
+
+	var plan struct {
+		Add          []string
+		Remove       []string
+		AddRules     []string
+		RemoveRules  []string
+		Unchanged    int
+		Foreign      []string
+		ForeignRules []string
+		Sinks        map[string]struct {
+			Add       []string
+			Remove    []string
+			Unchanged int
+		}
+	}
+	if err := apiGet(cfg, "plan", nil, &plan); err != nil {
+		return err
+	}
+
+	for _, v := range plan.Remove {
+		fmt.Println("- route", v)
+	}
+	for _, v := range plan.Add {
+		fmt.Println("+ route", v)
+	}
+	for _, v := range plan.RemoveRules {
+		fmt.Println("- rule", v)
+	}
+	for _, v := range plan.AddRules {
+		fmt.Println("+ rule", v)
+	}
+	for _, v := range plan.Foreign {
+		fmt.Println("? foreign route", v)
+	}
+	for _, v := range plan.ForeignRules {
+		fmt.Println("? foreign rule", v)
+	}
+	fmt.Printf("%d to add, %d to remove, %d unchanged\n", len(plan.Add)+len(plan.AddRules), len(plan.Remove)+len(plan.RemoveRules), plan.Unchanged)
+
+	names := make([]string, 0, len(plan.Sinks))
+	for name := range plan.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sink := plan.Sinks[name]
+		fmt.Printf("%s: %d to add, %d to remove, %d unchanged\n", name, len(sink.Add), len(sink.Remove), sink.Unchanged)
+	}
+	return nil
+}
+
+func rulesCommand(cfg *Config, args []string) error {
+	method := http.MethodGet
+	switch {
+	case len(args) == 1 && args[0] == "remove":
+		method = http.MethodDelete
+	case len(args) != 0:
+		return errors.New("usage: rules [remove]")
+	}
+
+	var result struct {
+		Managed bool
+		Rules   []string
+	}
+	if err := apiDo(cfg, method, "rules", nil, &result); err != nil {
+		return err
+	}
+
+	if method == http.MethodDelete {
+		fmt.Println("ip rules removed, they're left alone until the configuration is reloaded")
+		return nil
+	}
+	if !result.Managed {
+		fmt.Println("ip rules aren't managed")
+		return nil
+	}
+	if len(result.Rules) == 0 {
+		fmt.Println("No ip rules are configured")
+	}
+	for _, v := range result.Rules {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+// exitOnError reports a command failure and exits
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
@@ -6,30 +6,96 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	gct "github.com/freman/go-commontypes"
 	"github.com/naoina/toml"
 )
 
+// defaultRouteProtocol tags the routes and rules awsrangenf owns, it's well
+// clear of the numbers iproute2 knows about
+const defaultRouteProtocol = 175
+
+type Polling struct {
+	Enabled  bool
+	Interval gct.Duration
+}
+
+// SourceConfig describes an additional range list to import alongside AWS
+type SourceConfig struct {
+	Name        string
+	Provider    string
+	URL         gct.URL
+	MinPrefixes int
+	Polling     Polling
+}
+
 type Config struct {
-	Listen  string `json:"-"`
-	URL     gct.URL
-	Timeout gct.Duration
-	Store   string
-	IPv6    bool
-	Route   struct {
-		Table         int
-		Gateway       net.IP
-		actualGateway net.IP
+	Listen      string `json:"-"`
+	URL         gct.URL
+	Timeout     gct.Duration
+	Store       string
+	IPv6        bool
+	MinPrefixes int
+	History     int
+	Sources     []SourceConfig
+	Sinks       []string
+	Backends    []string `toml:",omitempty" json:"-"`
+	Files       []FileExport
+	Route       struct {
+		Table          int
+		Gateway        net.IP
+		Gateway6       net.IP
+		Device         string
+		Metric         int
+		Type           string
+		Scope          string
+		Nexthops       []Nexthop
+		Aggregate      bool
+		AllOrNothing   bool
+		Protocol       int
+		Realm          int
+		ManageRules    bool
+		Rules          []RuleConfig
+		actualGateway  net.IP
+		actualGateway6 net.IP
+		actualDevice6  string
 	}
 	Webhook struct {
 		Enabled bool
 		Key     string
 	}
-	Polling struct {
+	NFTables struct {
+		Table string
+		Set4  string
+		Set6  string
+	}
+	IPSet struct {
+		Set4 string
+		Set6 string
+	}
+	BGP BGPConfig
+	PAC struct {
+		Enabled bool
+		Path    string
+		Proxy   string
+	}
+	Polling Polling
+	Watch   struct {
 		Enabled  bool
-		Interval gct.Duration
+		Debounce gct.Duration
+	}
+	Health struct {
+		Enabled    bool
+		Interval   gct.Duration
+		Timeout    gct.Duration
+		Rise       int
+		Fall       int
+		Withdraw   bool
+		Fallback   string
+		ProbeTable int
+		Gateways   []HealthCheck
 	}
 }
 
@@ -44,14 +110,23 @@ func parseConfig(file string) (*Config, error) {
 		Listen:  ":8080",
 		URL:     gct.URL{URL: &url.URL{Scheme: "https", Host: "ip-ranges.amazonaws.com", Path: "/ip-ranges.json"}},
 		Timeout: gct.Duration{Duration: time.Minute},
+		History: 30,
 	}
 	if err := toml.NewDecoder(f).Decode(&config); err != nil {
 		return nil, fmt.Errorf("unable to parse configuration due to %v", err)
 	}
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
 
+// validateConfig checks the configuration and fills in the defaults, every
+// configuration is put through it however it arrives
+func validateConfig(config *Config) error {
 	host, port, err := net.SplitHostPort(config.Listen)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse listen address due to %v", err)
+		return fmt.Errorf("unable to parse listen address due to %v", err)
 	}
 	if host == "*" {
 		host = ""
@@ -61,12 +136,139 @@ func parseConfig(file string) (*Config, error) {
 	}
 	config.Listen = host + ":" + port
 
+	seen := map[string]struct{}{defaultNamespace: {}}
+	for i := range config.Sources {
+		source := &config.Sources[i]
+		provider, found := providers[source.Provider]
+		if !found {
+			return fmt.Errorf("unknown provider %q for source %q", source.Provider, source.Name)
+		}
+		if source.Name == "" {
+			source.Name = source.Provider
+		}
+		if strings.ContainsAny(source.Name, ":*") {
+			return fmt.Errorf("invalid source name %q", source.Name)
+		}
+		if _, dupe := seen[source.Name]; dupe {
+			return fmt.Errorf("duplicate source name %q", source.Name)
+		}
+		seen[source.Name] = struct{}{}
+		if source.URL.URL == nil {
+			if source.URL.URL, err = url.Parse(provider.DefaultURL()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Backends is what sinks used to be called
+	if len(config.Backends) > 0 {
+		if len(config.Sinks) > 0 {
+			return fmt.Errorf("backends is the old name for sinks, only set sinks")
+		}
+		config.Sinks, config.Backends = config.Backends, nil
+	}
+	if len(config.Sinks) == 0 {
+		config.Sinks = []string{defaultSink}
+	}
+	for _, v := range config.Sinks {
+		if _, found := sinks[v]; !found {
+			return fmt.Errorf("unknown sink %q", v)
+		}
+	}
+	if err := validateFileExports(config); err != nil {
+		return err
+	}
+	if config.NFTables.Table == "" {
+		config.NFTables.Table = "awsrangenf"
+	}
+	if config.NFTables.Set4 == "" {
+		config.NFTables.Set4 = "aws4"
+	}
+	if config.NFTables.Set6 == "" {
+		config.NFTables.Set6 = "aws6"
+	}
+
+	if config.IPSet.Set4 == "" {
+		config.IPSet.Set4 = "aws4"
+	}
+	if config.IPSet.Set6 == "" {
+		config.IPSet.Set6 = "aws6"
+	}
+
+	if err := validatePAC(config); err != nil {
+		return err
+	}
+
+	if err := validateBGP(config); err != nil {
+		return fmt.Errorf("bgp: %v", err)
+	}
+
+	for i := range config.Route.Nexthops {
+		if err := config.Route.Nexthops[i].validate(); err != nil {
+			return fmt.Errorf("route nexthop %d: %v", i+1, err)
+		}
+	}
+
+	if config.Route.Protocol == 0 {
+		config.Route.Protocol = defaultRouteProtocol
+	}
+	if config.Route.Protocol <= 4 || config.Route.Protocol > 255 {
+		return fmt.Errorf("route protocol %d is reserved or out of range, use 5-255", config.Route.Protocol)
+	}
+	if config.Route.Realm < 0 || config.Route.Realm > 65535 {
+		return fmt.Errorf("bad route realm %d", config.Route.Realm)
+	}
+
+	for i, v := range config.Route.Rules {
+		if v.Priority < 0 || v.Priority > 32765 {
+			return fmt.Errorf("route rule %d: bad priority %d", i+1, v.Priority)
+		}
+		for _, from := range v.From {
+			if from.IPNet == nil {
+				return fmt.Errorf("route rule %d: missing source subnet", i+1)
+			}
+		}
+	}
+
+	if err := validateRouteType(config.Route.Type); err != nil {
+		return err
+	}
+	if config.Route.Scope != "" && config.Route.Scope != "link" {
+		return fmt.Errorf("bad route scope %q, only link is supported", config.Route.Scope)
+	} else if config.Route.Scope == "link" && config.Route.Device == "" {
+		return fmt.Errorf("route scope link needs a device to send the routes out of")
+	}
+	if err := validateRouteType(config.Health.Fallback); err != nil || config.Health.Fallback == "unicast" {
+		return fmt.Errorf("health fallback must be blackhole, unreachable or prohibit")
+	}
+
+	for i, v := range config.Health.Gateways {
+		if err := validateHealthCheck(v); err != nil {
+			return fmt.Errorf("health check %d: %v", i+1, err)
+		}
+	}
+	if config.Health.ProbeTable == 0 {
+		config.Health.ProbeTable = defaultHealthProbeTable
+	}
+	if last := config.Health.ProbeTable + len(config.Health.Gateways); config.Health.ProbeTable < 256 || last > 1<<31 {
+		return fmt.Errorf("bad health probe table %d, use 256 or more", config.Health.ProbeTable)
+	} else if config.Route.Table >= config.Health.ProbeTable && config.Route.Table < last {
+		return fmt.Errorf("health probe tables %d-%d include the route table %d", config.Health.ProbeTable, last-1, config.Route.Table)
+	}
+
 	config.Route.actualGateway = config.Route.Gateway
 	if config.Route.Gateway.IsUnspecified() {
-		config.Route.actualGateway = DefaultRoute()
+		config.Route.actualGateway, _ = DefaultRoute(false)
 	}
 
-	return &config, nil
+	config.Route.actualGateway6 = config.Route.Gateway6
+	if config.IPv6 && (config.Route.Gateway6 == nil || config.Route.Gateway6.IsUnspecified()) {
+		config.Route.actualGateway6, config.Route.actualDevice6 = DefaultRoute(true)
+	} else if config.Route.Gateway6.IsLinkLocalUnicast() && config.Route.Device == "" {
+		return fmt.Errorf("gateway6 is link-local, the route needs a device to reach it through")
+	}
+
+	return nil
 }
 
 func saveConfig(file string, from interface{}) error {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(file, []byte("backends = [\"nftables\", \"ipset\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"nftables", "ipset"}; !reflect.DeepEqual(c.Sinks, expect) || c.Backends != nil {
+		t.Errorf("Expected backends to become sinks %v got %v and %v", expect, c.Sinks, c.Backends)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("sinks = [\"netlink\"]\nbackends = [\"ipset\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig(file); err == nil {
+		t.Error("Expected sinks and backends together to be refused")
+	}
+}
+
+func TestValidateConfigSources(t *testing.T) {
+	c := &Config{Listen: ":8080", Sources: []SourceConfig{{Provider: "nope"}}}
+	if err := validateConfig(c); err == nil {
+		t.Error("Expected an unknown provider to be refused")
+	}
+	if _, err := newSource(c.Sources[0]); err == nil {
+		t.Error("Expected a source with an unknown provider not to be created")
+	}
+
+	c.Sources[0].Provider = "gcp"
+	if err := validateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Sources[0].Name != "gcp" || c.Sources[0].URL.URL == nil {
+		t.Errorf("Expected the source name and url to default got %+v", c.Sources[0])
+	}
+}
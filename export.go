@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultExportName = "awsrangenf"
+
+// Export is the selected prefixes as they're rendered for another router,
+// the gateways and table are the ones on that router
+type Export struct {
+	Name     string
+	Gateway  net.IP
+	Gateway6 net.IP
+	Table    string
+	IPv4     []*net.IPNet
+	IPv6     []*net.IPNet
+}
+
+// exporters render an export in the configuration language of a router
+var exporters = map[string]func(w io.Writer, e *Export){
+	"bird":     exportBIRD,
+	"frr":      exportFRR,
+	"cisco":    exportCisco,
+	"junos":    exportJunos,
+	"mikrotik": exportMikroTik,
+}
+
+// FileExport is an export the file sink keeps written out whenever the
+// routes change, eg. for a BIRD running alongside to include
+type FileExport struct {
+	Path     string
+	Format   string
+	Name     string
+	Table    string
+	Gateway  net.IP
+	Gateway6 net.IP
+}
+
+var validExportName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// exportFormats lists the known formats in order
+func exportFormats() []string {
+	formats := make([]string, 0, len(exporters))
+	for k := range exporters {
+		formats = append(formats, k)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// export collects the aggregated destinations of the routes, the gateways
+// default to the ones used here. A link-local IPv6 gateway means nothing
+// without the interface it's on here so it's only a default when global
+func (a *app) export(routes []*Route, name, table string, gateway, gateway6 net.IP) (*Export, error) {
+	if name == "" {
+		name = defaultExportName
+	}
+	if !validExportName.MatchString(name) {
+		return nil, fmt.Errorf("invalid export name %q", name)
+	}
+	if strings.ContainsAny(table, " \t\r\n\"';{}") {
+		return nil, fmt.Errorf("invalid export table %q", table)
+	}
+
+	e := &Export{Name: name, Table: table, Gateway: gateway, Gateway6: gateway6}
+	if e.Gateway == nil {
+		e.Gateway = a.config.Route.actualGateway
+	}
+	if e.Gateway6 == nil && !a.config.Route.actualGateway6.IsLinkLocalUnicast() {
+		e.Gateway6 = a.config.Route.actualGateway6
+	}
+
+	e.IPv4, e.IPv6 = splitFamilies(aggregateNetworks(destinations(routes)))
+	if len(e.IPv4) > 0 && (e.Gateway == nil || e.Gateway.To4() == nil) {
+		return nil, fmt.Errorf("export needs an IPv4 gateway")
+	}
+	if len(e.IPv6) > 0 && (e.Gateway6 == nil || e.Gateway6.To4() != nil) {
+		return nil, fmt.Errorf("export needs an IPv6 gateway")
+	}
+	if len(e.IPv6) > 0 && e.Gateway6.IsLinkLocalUnicast() {
+		return nil, fmt.Errorf("export needs a global IPv6 gateway, %s is link-local", e.Gateway6)
+	}
+	return e, nil
+}
+
+func validateFileExports(c *Config) error {
+	if c.sink("file") && len(c.Files) == 0 {
+		return errors.New("the file sink needs files to export to")
+	}
+	for i, v := range c.Files {
+		if v.Path == "" {
+			return fmt.Errorf("file export %d is missing a path", i+1)
+		}
+		if _, found := exporters[v.Format]; !found {
+			return fmt.Errorf("file export %s: unknown format %q, expected one of: %s", v.Path, v.Format, strings.Join(exportFormats(), ", "))
+		}
+		if v.Gateway6.IsLinkLocalUnicast() {
+			return fmt.Errorf("file export %s: gateway6 %s is link-local, it needs to be global", v.Path, v.Gateway6)
+		}
+	}
+	return nil
+}
+
+// fileSink keeps the configured exports written out
+type fileSink struct {
+	sinkState
+	a *app
+}
+
+// exportedNetwork finds the prefixes in an export, every format has each of
+// them in prefix notation at least once
+var exportedNetwork = regexp.MustCompile(`[0-9A-Fa-f:.]+/[0-9]+`)
+
+// Plan compares the exports with what's in the files now, counting each
+// file on its own. When the name, table or gateways change every prefix in
+// the file changes with them
+func (s *fileSink) Plan(routes []*Route) (*Plan, error) {
+	plan := &Plan{}
+	for _, f := range s.a.config.Files {
+		e, err := s.a.export(routes, f.Name, f.Table, f.Gateway, f.Gateway6)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Path, err)
+		}
+
+		current, err := ioutil.ReadFile(f.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %v", f.Path, err)
+		}
+		var networks []*net.IPNet
+		for _, v := range exportedNetwork.FindAll(current, -1) {
+			if _, network, err := net.ParseCIDR(string(v)); err == nil {
+				networks = append(networks, network)
+			}
+		}
+		networks = aggregateNetworks(networks)
+
+		wanted := append(append([]*net.IPNet{}, e.IPv4...), e.IPv6...)
+		filePlan := planNetworks(wanted, networks)
+		if len(current) > 0 {
+			var buf bytes.Buffer
+			was := *e
+			was.IPv4, was.IPv6 = splitFamilies(networks)
+			if exporters[f.Format](&buf, &was); !bytes.Equal(buf.Bytes(), current) {
+				filePlan = planNetworks(wanted, nil)
+				for _, v := range networks {
+					filePlan.Remove = append(filePlan.Remove, &Route{Dst: v})
+				}
+			}
+		}
+
+		plan.Add = append(plan.Add, filePlan.Add...)
+		plan.Remove = append(plan.Remove, filePlan.Remove...)
+		plan.Unchanged += filePlan.Unchanged
+	}
+	return plan, nil
+}
+
+func (s *fileSink) Apply(routes []*Route) error {
+	var errs []string
+	for _, v := range s.a.config.Files {
+		if err := writeExport(s.a, v, routes); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", v.Path, err))
+		}
+	}
+	if len(errs) > 0 {
+		return s.record(routes, errors.New(strings.Join(errs, "\n")))
+	}
+	return s.record(routes, nil)
+}
+
+// writeExport renders the export and replaces the file with it if it
+// changed
+func writeExport(a *app, f FileExport, routes []*Route) error {
+	e, err := a.export(routes, f.Name, f.Table, f.Gateway, f.Gateway6)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	exporters[f.Format](&buf, e)
+	if current, err := ioutil.ReadFile(f.Path); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(f.Path+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Path+".tmp", f.Path); err != nil {
+		os.Remove(f.Path + ".tmp")
+		return err
+	}
+	a.log.Println("Exported", len(e.IPv4)+len(e.IPv6), "prefixes to", f.Path)
+	return nil
+}
+
+// exportBIRD renders a static protocol per family for BIRD 2
+func exportBIRD(w io.Writer, e *Export) {
+	fmt.Fprintln(w, "# Generated by awsrangenf")
+	for _, family := range []struct {
+		channel  string
+		suffix   string
+		gateway  net.IP
+		networks []*net.IPNet
+	}{
+		{"ipv4", "4", e.Gateway, e.IPv4},
+		{"ipv6", "6", e.Gateway6, e.IPv6},
+	} {
+		if len(family.networks) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "protocol static %s%s {\n", e.Name, family.suffix)
+		if e.Table != "" {
+			fmt.Fprintf(w, "\t%s { table %s; };\n", family.channel, e.Table)
+		} else {
+			fmt.Fprintf(w, "\t%s;\n", family.channel)
+		}
+		for _, v := range family.networks {
+			fmt.Fprintf(w, "\troute %s via %s;\n", v, family.gateway)
+		}
+		fmt.Fprintln(w, "}")
+	}
+}
+
+// exportFRR renders prefix lists and static routes for FRR or Quagga
+func exportFRR(w io.Writer, e *Export) {
+	fmt.Fprintln(w, "! Generated by awsrangenf")
+	table := ""
+	if e.Table != "" {
+		table = " table " + e.Table
+	}
+	for i, v := range e.IPv4 {
+		fmt.Fprintf(w, "ip prefix-list %s seq %d permit %s\n", e.Name, (i+1)*5, v)
+	}
+	for i, v := range e.IPv6 {
+		fmt.Fprintf(w, "ipv6 prefix-list %s seq %d permit %s\n", e.Name, (i+1)*5, v)
+	}
+	for _, v := range e.IPv4 {
+		fmt.Fprintf(w, "ip route %s %s%s\n", v, e.Gateway, table)
+	}
+	for _, v := range e.IPv6 {
+		fmt.Fprintf(w, "ipv6 route %s %s%s\n", v, e.Gateway6, table)
+	}
+}
+
+// exportCisco renders prefix lists and static routes for Cisco IOS, the
+// table is a VRF
+func exportCisco(w io.Writer, e *Export) {
+	fmt.Fprintln(w, "! Generated by awsrangenf")
+	vrf := ""
+	if e.Table != "" {
+		vrf = "vrf " + e.Table + " "
+	}
+	for i, v := range e.IPv4 {
+		fmt.Fprintf(w, "ip prefix-list %s seq %d permit %s\n", e.Name, (i+1)*5, v)
+	}
+	for i, v := range e.IPv6 {
+		fmt.Fprintf(w, "ipv6 prefix-list %s seq %d permit %s\n", e.Name, (i+1)*5, v)
+	}
+	for _, v := range e.IPv4 {
+		fmt.Fprintf(w, "ip route %s%s %s %s\n", vrf, v.IP, net.IP(v.Mask), e.Gateway)
+	}
+	for _, v := range e.IPv6 {
+		fmt.Fprintf(w, "ipv6 route %s%s %s\n", vrf, v, e.Gateway6)
+	}
+}
+
+// exportJunos renders set commands for Junos, the table is a routing
+// instance
+func exportJunos(w io.Writer, e *Export) {
+	fmt.Fprintln(w, "# Generated by awsrangenf")
+	prefix, rib6 := "set routing-options", "inet6.0"
+	if e.Table != "" {
+		prefix, rib6 = "set routing-instances "+e.Table+" routing-options", e.Table+".inet6.0"
+	}
+	for _, v := range append(append([]*net.IPNet{}, e.IPv4...), e.IPv6...) {
+		fmt.Fprintf(w, "set policy-options prefix-list %s %s\n", e.Name, v)
+	}
+	for _, v := range e.IPv4 {
+		fmt.Fprintf(w, "%s static route %s next-hop %s\n", prefix, v, e.Gateway)
+	}
+	for _, v := range e.IPv6 {
+		fmt.Fprintf(w, "%s rib %s static route %s next-hop %s\n", prefix, rib6, v, e.Gateway6)
+	}
+}
+
+// exportMikroTik renders a RouterOS 7 script that replaces the address
+// lists and routes from any earlier run of it
+func exportMikroTik(w io.Writer, e *Export) {
+	fmt.Fprintln(w, "# Generated by awsrangenf")
+	table := ""
+	if e.Table != "" {
+		table = " routing-table=" + e.Table
+	}
+	for _, family := range []struct {
+		menu     string
+		gateway  net.IP
+		networks []*net.IPNet
+	}{
+		{"/ip", e.Gateway, e.IPv4},
+		{"/ipv6", e.Gateway6, e.IPv6},
+	} {
+		fmt.Fprintf(w, "%s firewall address-list remove [find list=%s]\n", family.menu, e.Name)
+		fmt.Fprintf(w, "%s route remove [find comment=%s]\n", family.menu, e.Name)
+		for _, v := range family.networks {
+			fmt.Fprintf(w, "%s firewall address-list add list=%s address=%s\n", family.menu, e.Name, v)
+		}
+		for _, v := range family.networks {
+			fmt.Fprintf(w, "%s route add dst-address=%s gateway=%s%s comment=%s\n", family.menu, v, family.gateway, table, e.Name)
+		}
+	}
+}
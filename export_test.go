@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExporters(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	e := &Export{
+		Name:     "aws",
+		Gateway:  net.ParseIP("10.0.0.1"),
+		Gateway6: net.ParseIP("2001:db8::1"),
+		IPv4:     []*net.IPNet{network("52.94.0.0/23")},
+		IPv6:     []*net.IPNet{network("2600:1f18::/32")},
+	}
+
+	tests := map[string]string{
+		"bird": `# Generated by awsrangenf
+protocol static aws4 {
+	ipv4;
+	route 52.94.0.0/23 via 10.0.0.1;
+}
+protocol static aws6 {
+	ipv6;
+	route 2600:1f18::/32 via 2001:db8::1;
+}
+`,
+		"frr": `! Generated by awsrangenf
+ip prefix-list aws seq 5 permit 52.94.0.0/23
+ipv6 prefix-list aws seq 5 permit 2600:1f18::/32
+ip route 52.94.0.0/23 10.0.0.1
+ipv6 route 2600:1f18::/32 2001:db8::1
+`,
+		"cisco": `! Generated by awsrangenf
+ip prefix-list aws seq 5 permit 52.94.0.0/23
+ipv6 prefix-list aws seq 5 permit 2600:1f18::/32
+ip route 52.94.0.0 255.255.254.0 10.0.0.1
+ipv6 route 2600:1f18::/32 2001:db8::1
+`,
+		"junos": `# Generated by awsrangenf
+set policy-options prefix-list aws 52.94.0.0/23
+set policy-options prefix-list aws 2600:1f18::/32
+set routing-options static route 52.94.0.0/23 next-hop 10.0.0.1
+set routing-options rib inet6.0 static route 2600:1f18::/32 next-hop 2001:db8::1
+`,
+		"mikrotik": `# Generated by awsrangenf
+/ip firewall address-list remove [find list=aws]
+/ip route remove [find comment=aws]
+/ip firewall address-list add list=aws address=52.94.0.0/23
+/ip route add dst-address=52.94.0.0/23 gateway=10.0.0.1 comment=aws
+/ipv6 firewall address-list remove [find list=aws]
+/ipv6 route remove [find comment=aws]
+/ipv6 firewall address-list add list=aws address=2600:1f18::/32
+/ipv6 route add dst-address=2600:1f18::/32 gateway=2001:db8::1 comment=aws
+`,
+	}
+	for format, expect := range tests {
+		var buf bytes.Buffer
+		exporters[format](&buf, e)
+		if got := buf.String(); got != expect {
+			t.Errorf("Expected %s export:\n%s\ngot:\n%s", format, expect, got)
+		}
+	}
+
+	e.Table = "blue"
+	var buf bytes.Buffer
+	exportCisco(&buf, e)
+	if expect := "ip route vrf blue 52.94.0.0 255.255.254.0 10.0.0.1\n"; !bytes.Contains(buf.Bytes(), []byte(expect)) {
+		t.Errorf("Expected %q in %s", expect, buf.String())
+	}
+}
+
+func TestExportGateway6(t *testing.T) {
+	_, dst6, _ := net.ParseCIDR("2600:1f18::/32")
+	routes := []*Route{{Dst: dst6}}
+
+	a := &app{config: &Config{}}
+	a.config.Route.actualGateway6 = net.ParseIP("fe80::1")
+	if _, err := a.export(routes, "", "", nil, nil); err == nil {
+		t.Error("Expected the link-local gateway not to be exported")
+	}
+	if _, err := a.export(routes, "", "", nil, net.ParseIP("fe80::2")); err == nil {
+		t.Error("Expected a link-local gateway to be refused")
+	}
+
+	e, err := a.export(routes, "", "", nil, net.ParseIP("2001:db8::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Gateway6.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Expected gateway6 2001:db8::1 got %s", e.Gateway6)
+	}
+
+	a.config.Route.actualGateway6 = net.ParseIP("2001:db8::2")
+	if e, err = a.export(routes, "", "", nil, nil); err != nil || !e.Gateway6.Equal(a.config.Route.actualGateway6) {
+		t.Errorf("Expected the global gateway here to be the default got %v, %v", e, err)
+	}
+}
+
+func TestFileSinkPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	a := &app{config: &Config{}}
+	a.config.Files = []FileExport{{Path: filepath.Join(dir, "aws.conf"), Format: "cisco", Gateway: net.ParseIP("10.0.0.1")}}
+	s := &fileSink{a: a}
+
+	routes := []*Route{{Dst: network("52.94.0.0/24")}, {Dst: network("52.94.1.0/24")}}
+	if plan, err := s.Plan(routes); err != nil || len(plan.Add) != 1 || plan.Unchanged != 0 {
+		t.Errorf("Expected the aggregate to be added without a file got %+v %v", plan, err)
+	}
+
+	e, _ := a.export(routes, "", "", net.ParseIP("10.0.0.1"), nil)
+	var buf bytes.Buffer
+	exportCisco(&buf, e)
+	if err := ioutil.WriteFile(a.config.Files[0].Path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes = append(routes, &Route{Dst: network("52.94.4.0/24")})
+	if plan, err := s.Plan(routes); err != nil || len(plan.Add) != 1 || len(plan.Remove) != 0 || plan.Unchanged != 1 {
+		t.Errorf("Expected 1 added and 1 unchanged got %+v %v", plan, err)
+	}
+
+	a.config.Files[0].Gateway = net.ParseIP("10.0.0.2")
+	if plan, err := s.Plan(routes); err != nil || len(plan.Add) != 2 || len(plan.Remove) != 1 || plan.Unchanged != 0 {
+		t.Errorf("Expected a new gateway to change every prefix got %+v %v", plan, err)
+	}
+}
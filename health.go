@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxHealthEvents = 100
+const defaultHealthInterval = 5 * time.Second
+const defaultHealthTimeout = time.Second
+const defaultHealthThreshold = 3
+
+// Probes are forced through their gateway by a rule sending packets marked
+// with the table number to a table holding a route to the target via it,
+// each gateway has a table of its own from the probe table on
+const defaultHealthProbeTable = 17500
+const healthProbePriority = 10
+
+// HealthCheck probes a gateway, its neighbour entry is always checked and
+// an ICMP or TCP probe to a target sent through it can be added on top.
+// Gateways are listed in order of preference, routes via a failed gateway
+// move to the first healthy one of the same family.
+type HealthCheck struct {
+	Gateway net.IP
+	Probe   string
+	Target  string
+}
+
+// GatewayStatus is the health of a checked gateway
+type GatewayStatus struct {
+	Gateway   string
+	Healthy   bool
+	Probe     string `json:",omitempty"`
+	LastCheck time.Time
+	LastError string `json:",omitempty"`
+
+	successes, failures int
+}
+
+// HealthEvent records a gateway going up or down
+type HealthEvent struct {
+	Time    time.Time
+	Gateway string
+	Healthy bool
+	Error   string `json:",omitempty"`
+}
+
+type healthState struct {
+	sync.Mutex
+	gateways map[string]*GatewayStatus
+	links    map[string]bool
+	history  []HealthEvent
+}
+
+func validateHealthCheck(check HealthCheck) error {
+	if check.Gateway == nil {
+		return errors.New("missing gateway")
+	}
+	target := check.Target
+	switch check.Probe {
+	case "":
+		return nil
+	case "icmp":
+		if net.ParseIP(check.Target) == nil {
+			return fmt.Errorf("icmp probe target %q isn't an ip", check.Target)
+		}
+	case "tcp":
+		var err error
+		if target, _, err = net.SplitHostPort(check.Target); err != nil {
+			return fmt.Errorf("tcp probe target %q: %v", check.Target, err)
+		}
+	default:
+		return fmt.Errorf("unknown probe %q, expected icmp or tcp", check.Probe)
+	}
+	if ip := net.ParseIP(target); ip != nil && (ip.To4() == nil) != (check.Gateway.To4() == nil) {
+		return fmt.Errorf("probe target %s isn't the same family as the gateway", target)
+	}
+	return nil
+}
+
+// healthChecks runs the configured checks on every interval
+func (a *app) healthChecks() {
+	for {
+		interval := a.config.Health.Interval.Duration
+		if interval <= 0 {
+			interval = defaultHealthInterval
+		}
+		time.Sleep(interval)
+
+		if a.config.Health.Enabled && a.checkGateways() && a.ready() {
+			if err := SetRoutes(a); err != nil {
+				a.log.Println("Unable to fail over routes due to", err)
+			}
+		}
+	}
+}
+
+// checkGateways probes every gateway, reporting if any changed state
+func (a *app) checkGateways() bool {
+	timeout := a.config.Health.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+
+	a.health.prune(a.config)
+
+	changed := false
+	for i, check := range a.config.Health.Gateways {
+		err := checkNeighbour(check.Gateway, timeout)
+		if err == nil {
+			err = a.probe(i, check, timeout)
+		}
+		if a.health.record(a.config, check, err) {
+			changed = true
+		}
+	}
+	return a.checkLinks() || changed
+}
+
+// checkLinks checks the devices of every device route, reporting if any
+// went up or down
+func (a *app) checkLinks() bool {
+	devices := map[string]struct{}{}
+	if a.ready() {
+		for _, v := range a.selectedRoutes() {
+			if v.deviceOnly() {
+				devices[v.Device] = struct{}{}
+			}
+		}
+	}
+
+	changed := a.health.pruneLinks(devices)
+	for device := range devices {
+		if a.health.recordLink(device, checkLink(device)) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// linksChanged puts the routes right after a device went up or down
+func (a *app) linksChanged() {
+	if a.config.Health.Enabled && a.checkLinks() && a.ready() {
+		if err := SetRoutes(a); err != nil {
+			a.log.Println("Unable to fail over device routes due to", err)
+		}
+	}
+}
+
+// record updates the state of a gateway with hysteresis, a gateway goes
+// down after fall failures in a row and comes back after rise successes
+func (h *healthState) record(c *Config, check HealthCheck, err error) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.gateways == nil {
+		h.gateways = map[string]*GatewayStatus{}
+	}
+	status, found := h.gateways[check.Gateway.String()]
+	if !found {
+		status = &GatewayStatus{Gateway: check.Gateway.String(), Healthy: true}
+		h.gateways[status.Gateway] = status
+	}
+
+	status.Probe = check.Probe
+	status.LastCheck = time.Now()
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	if err != nil {
+		status.successes, status.failures = 0, status.failures+1
+	} else {
+		status.successes, status.failures = status.successes+1, 0
+	}
+
+	rise, fall := c.Health.Rise, c.Health.Fall
+	if rise <= 0 {
+		rise = defaultHealthThreshold
+	}
+	if fall <= 0 {
+		fall = defaultHealthThreshold
+	}
+
+	switch {
+	case status.Healthy && status.failures >= fall:
+		status.Healthy = false
+	case !status.Healthy && status.successes >= rise:
+		status.Healthy = true
+	default:
+		return false
+	}
+
+	h.history = append(h.history, HealthEvent{Time: status.LastCheck, Gateway: status.Gateway, Healthy: status.Healthy, Error: status.LastError})
+	if n := len(h.history); n > maxHealthEvents {
+		h.history = append([]HealthEvent(nil), h.history[n-maxHealthEvents:]...)
+	}
+	return true
+}
+
+// recordLink updates the state of a device, unlike gateways there's no
+// hysteresis as the kernel already knows if a device is up
+func (h *healthState) recordLink(device string, err error) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.links == nil {
+		h.links = map[string]bool{}
+	}
+	up, found := h.links[device]
+	if h.links[device] = err == nil; found && up == (err == nil) || !found && err == nil {
+		return false
+	}
+
+	event := HealthEvent{Time: time.Now(), Gateway: "dev " + device, Healthy: err == nil}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	h.history = append(h.history, event)
+	if n := len(h.history); n > maxHealthEvents {
+		h.history = append([]HealthEvent(nil), h.history[n-maxHealthEvents:]...)
+	}
+	return true
+}
+
+// pruneLinks forgets devices no longer routed through, reporting if any of
+// them were down
+func (h *healthState) pruneLinks(devices map[string]struct{}) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	changed := false
+	for device, up := range h.links {
+		if _, found := devices[device]; !found {
+			delete(h.links, device)
+			changed = changed || !up
+		}
+	}
+	return changed
+}
+
+// linkUp reports if a device can be routed through, devices that haven't
+// been checked always can
+func (h *healthState) linkUp(device string) bool {
+	h.Lock()
+	defer h.Unlock()
+	if up, found := h.links[device]; found {
+		return up
+	}
+	return true
+}
+
+// prune forgets gateways that are no longer checked
+func (h *healthState) prune(c *Config) {
+	h.Lock()
+	defer h.Unlock()
+
+	checked := make(map[string]struct{}, len(c.Health.Gateways))
+	for _, check := range c.Health.Gateways {
+		checked[check.Gateway.String()] = struct{}{}
+	}
+	for gateway := range h.gateways {
+		if _, found := checked[gateway]; !found {
+			delete(h.gateways, gateway)
+		}
+	}
+}
+
+// healthy reports if a gateway can be used, gateways that aren't checked
+// always can
+func (h *healthState) healthy(gateway net.IP) bool {
+	h.Lock()
+	defer h.Unlock()
+	if status, found := h.gateways[gateway.String()]; found {
+		return status.Healthy
+	}
+	return true
+}
+
+// status returns the checked gateways in order of preference and the
+// history of changes, most recent first
+func (h *healthState) status(c *Config) ([]GatewayStatus, []HealthEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	statuses := []GatewayStatus{}
+	for _, check := range c.Health.Gateways {
+		status, found := h.gateways[check.Gateway.String()]
+		if !found {
+			status = &GatewayStatus{Gateway: check.Gateway.String(), Healthy: true, Probe: check.Probe}
+		}
+		statuses = append(statuses, *status)
+	}
+
+	history := make([]HealthEvent, len(h.history))
+	for i, v := range h.history {
+		history[len(h.history)-1-i] = v
+	}
+	return statuses, history
+}
+
+// failover moves routes off failed gateways, to the first healthy checked
+// gateway of the same family. When there isn't one, or the device of a
+// device route is down, they become fallback routes, eg. blackhole as a
+// kill switch, or are dropped if withdraw is set.
+func (a *app) failover(routes []*Route) []*Route {
+	if !a.config.Health.Enabled {
+		return routes
+	}
+
+	backup := func(ipv6 bool) net.IP {
+		for _, check := range a.config.Health.Gateways {
+			if (check.Gateway.To4() == nil) == ipv6 && a.health.healthy(check.Gateway) {
+				return check.Gateway
+			}
+		}
+		return nil
+	}
+
+	failedOver := make([]*Route, 0, len(routes))
+	for _, v := range routes {
+		route := *v
+		if len(route.Nexthops) > 0 {
+			route.Nexthops = nil
+			for _, nexthop := range v.Nexthops {
+				if a.health.healthy(nexthop.Gateway) {
+					route.Nexthops = append(route.Nexthops, nexthop)
+				}
+			}
+			if len(route.Nexthops) > 0 {
+				failedOver = append(failedOver, &route)
+				continue
+			}
+		} else if route.deviceOnly() {
+			if a.health.linkUp(route.Device) {
+				failedOver = append(failedOver, &route)
+				continue
+			}
+		} else if route.Gateway == nil || a.health.healthy(route.Gateway) {
+			failedOver = append(failedOver, &route)
+			continue
+		}
+
+		// Device routes have nowhere else to go
+		if !route.deviceOnly() {
+			if route.Gateway = backup(route.Dst.IP.To4() == nil); route.Gateway != nil {
+				failedOver = append(failedOver, &route)
+				continue
+			}
+		}
+
+		if a.config.Health.Fallback != "" {
+			route.Type, route.Device = a.config.Health.Fallback, ""
+			failedOver = append(failedOver, &route)
+		} else if !a.config.Health.Withdraw {
+			failedOver = append(failedOver, v)
+		}
+	}
+	return failedOver
+}
+
+// probe checks a target can be reached through the gateway, the probe is
+// sent through it wherever the target is routed
+func (a *app) probe(index int, check HealthCheck, timeout time.Duration) error {
+	if check.Probe == "" {
+		return nil
+	}
+	target, address, err := probeTarget(check)
+	if err != nil {
+		return err
+	}
+
+	control, done, err := probeThrough(a, index, check.Gateway, target)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	switch check.Probe {
+	case "icmp":
+		return pingICMP(target, timeout, control)
+	case "tcp":
+		dialer := net.Dialer{Timeout: timeout, Control: control}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return nil
+}
+
+// probeTarget resolves the target of the probe to an address of the
+// gateway's family, and the address to dial for tcp probes
+func probeTarget(check HealthCheck) (net.IP, string, error) {
+	host, port := check.Target, ""
+	if check.Probe == "tcp" {
+		host, port, _ = net.SplitHostPort(check.Target)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (check.Gateway.To4() == nil) {
+			if ip.To4() != nil {
+				ip = ip.To4()
+			}
+			if check.Probe == "tcp" {
+				return ip, net.JoinHostPort(ip.String(), port), nil
+			}
+			return ip, ip.String(), nil
+		}
+	}
+	return nil, "", fmt.Errorf("probe target %s has no address of the gateway's family", host)
+}
+
+// pingICMP sends a single echo request and waits for the reply
+func pingICMP(target net.IP, timeout time.Duration, control func(network, address string, c syscall.RawConn) error) error {
+	network, request, reply := "ip4:icmp", byte(8), byte(0)
+	if target.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", 128, 129
+	}
+
+	listener := net.ListenConfig{Control: control}
+	conn, err := listener.ListenPacket(context.Background(), network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	seq := uint16(time.Now().UnixNano())
+	msg := []byte{request, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq), 'a', 'w', 's'}
+	if request == 8 {
+		// The kernel works out the checksum for ICMPv6
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: target}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n >= 8 && buf[0] == reply && binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq &&
+			from.(*net.IPAddr).IP.Equal(target) {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
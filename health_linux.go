@@ -0,0 +1,130 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// usableNeighbour are the states of a neighbour that can be sent to
+const usableNeighbour = netlink.NUD_REACHABLE | netlink.NUD_STALE | netlink.NUD_DELAY | netlink.NUD_PROBE | netlink.NUD_PERMANENT | netlink.NUD_NOARP
+
+// checkNeighbour fails a gateway the kernel couldn't resolve. A gateway
+// without a neighbour entry hasn't been needed yet, something is sent to it
+// so the kernel resolves it and it's failed if that doesn't happen in time
+func checkNeighbour(gateway net.IP, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	resolving := false
+	for {
+		neighbour, err := findNeighbour(gateway)
+		if err != nil {
+			return err
+		}
+		switch {
+		case neighbour != nil && neighbour.State&usableNeighbour != 0:
+			return nil
+		case neighbour != nil && neighbour.State&netlink.NUD_FAILED != 0:
+			return fmt.Errorf("neighbour %s is unreachable", gateway)
+		case neighbour == nil && !resolving:
+			resolving = true
+			if conn, err := net.Dial("udp", net.JoinHostPort(gateway.String(), "9")); err == nil {
+				conn.Write([]byte{0})
+				conn.Close()
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("neighbour %s couldn't be resolved", gateway)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// findNeighbour returns the neighbour entry of the gateway, if it has one
+func findNeighbour(gateway net.IP) (*netlink.Neigh, error) {
+	family := netlink.FAMILY_V4
+	if gateway.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	neighbours, err := netlink.NeighList(0, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range neighbours {
+		if v.IP.Equal(gateway) {
+			return &v, nil
+		}
+	}
+	return nil, nil
+}
+
+// probeThrough forces a probe through the gateway. Its packets are marked
+// and while it runs a rule sends marked packets to a table of the gateway's
+// own holding a route to the target via the gateway
+func probeThrough(a *app, index int, gateway, target net.IP) (func(network, address string, c syscall.RawConn) error, func(), error) {
+	family, bits := netlink.FAMILY_V4, 32
+	if target.To4() == nil {
+		family, bits = netlink.FAMILY_V6, 128
+	}
+	table := a.config.Health.ProbeTable + index
+	mark, mask := uint32(table), ^uint32(0)
+
+	route := &netlink.Route{
+		Table:    table,
+		Dst:      &net.IPNet{IP: target, Mask: net.CIDRMask(bits, bits)},
+		Gw:       gateway,
+		Protocol: netlink.RouteProtocol(a.config.Route.Protocol),
+	}
+	if gateway.IsLinkLocalUnicast() {
+		// Only the neighbour entry knows which device it's on
+		if neighbour, err := findNeighbour(gateway); err == nil && neighbour != nil {
+			route.LinkIndex = neighbour.LinkIndex
+		}
+	}
+	rule := netlink.NewRule()
+	rule.Family, rule.Table, rule.Priority = family, table, healthProbePriority
+	rule.Mark, rule.Mask, rule.Protocol = mark, &mask, uint8(a.config.Route.Protocol)
+
+	if err := netlink.RouteReplace(route); err != nil {
+		return nil, nil, fmt.Errorf("probe route to %s via %s: %v", target, gateway, err)
+	}
+	if err := netlink.RuleAdd(rule); err != nil && err != syscall.EEXIST {
+		netlink.RouteDel(route)
+		return nil, nil, fmt.Errorf("probe rule for table %d: %v", table, err)
+	}
+
+	control := func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	done := func() {
+		netlink.RuleDel(rule)
+		netlink.RouteDel(route)
+	}
+	return control, done, nil
+}
+
+// checkLink fails a device that's missing or down
+func checkLink(device string) error {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return err
+	}
+
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 || attrs.OperState == netlink.OperDown || attrs.OperState == netlink.OperLowerLayerDown {
+		return fmt.Errorf("device %s is down", device)
+	}
+	return nil
+}
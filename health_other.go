@@ -0,0 +1,26 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// checkNeighbour can't see the neighbour table outside of linux so leaves
+// it to the probes
+func checkNeighbour(gateway net.IP, timeout time.Duration) error {
+	return nil
+}
+
+// probeThrough can't mark packets outside of linux, probes follow the
+// routing table wherever it sends them
+func probeThrough(a *app, index int, gateway, target net.IP) (func(network, address string, c syscall.RawConn) error, func(), error) {
+	return nil, func() {}, nil
+}
+
+// checkLink can't see devices outside of linux so they're always up
+func checkLink(device string) error {
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHealthHysteresis(t *testing.T) {
+	c := &Config{}
+	c.Health.Rise, c.Health.Fall = 2, 3
+	check := HealthCheck{Gateway: net.ParseIP("10.0.0.1").To4()}
+
+	h := &healthState{}
+	failed := errors.New("timeout")
+	steps := []struct {
+		err     error
+		changed bool
+		healthy bool
+	}{
+		{failed, false, true},
+		{failed, false, true},
+		{nil, false, true},
+		{failed, false, true},
+		{failed, false, true},
+		{failed, true, false},
+		{nil, false, false},
+		{failed, false, false},
+		{nil, false, false},
+		{nil, true, true},
+	}
+	for i, step := range steps {
+		if changed := h.record(c, check, step.err); changed != step.changed {
+			t.Errorf("Step %d expected changed %v got %v", i, step.changed, changed)
+		}
+		if healthy := h.healthy(check.Gateway); healthy != step.healthy {
+			t.Errorf("Step %d expected healthy %v got %v", i, step.healthy, healthy)
+		}
+	}
+
+	if _, history := h.status(c); len(history) != 2 || !history[0].Healthy || history[1].Healthy {
+		t.Errorf("Expected the gateway to go down then up got %v", history)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	route := func(s string) *Route {
+		custom, err := ParseCustomRoute(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Route{Dst: custom.IPNet, Gateway: custom.Gateway, Nexthops: custom.Nexthops}
+	}
+
+	primary, backup := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	a := &app{config: &Config{}}
+	a.config.Health.Enabled = true
+	a.config.Health.Gateways = []HealthCheck{{Gateway: primary}, {Gateway: backup}}
+	a.config.Health.Fall = 1
+
+	routes := []*Route{
+		route("52.94.0.0/24 via 10.0.0.1"),
+		route("52.94.1.0/24 via 10.0.0.9"),
+		route("52.94.2.0/24 nexthop via 10.0.0.1 nexthop via 10.0.0.3"),
+	}
+	failover := func() []string {
+		var got []string
+		for _, v := range a.failover(routes) {
+			got = append(got, v.String())
+		}
+		return got
+	}
+
+	expect := []string{
+		"52.94.0.0/24 via 10.0.0.1 table 0",
+		"52.94.1.0/24 via 10.0.0.9 table 0",
+		"52.94.2.0/24 table 0 nexthop via 10.0.0.1 nexthop via 10.0.0.3",
+	}
+	if got := failover(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+
+	a.health.record(a.config, HealthCheck{Gateway: primary}, errors.New("down"))
+	expect = []string{
+		"52.94.0.0/24 via 10.0.0.2 table 0",
+		"52.94.1.0/24 via 10.0.0.9 table 0",
+		"52.94.2.0/24 table 0 nexthop via 10.0.0.3",
+	}
+	if got := failover(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected failover %v got %v", expect, got)
+	}
+
+	a.health.record(a.config, HealthCheck{Gateway: backup}, errors.New("down"))
+	a.config.Health.Withdraw = true
+	expect = []string{
+		"52.94.1.0/24 via 10.0.0.9 table 0",
+		"52.94.2.0/24 table 0 nexthop via 10.0.0.3",
+	}
+	if got := failover(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected withdrawal %v got %v", expect, got)
+	}
+}
+
+func TestFailoverDevice(t *testing.T) {
+	a := &app{config: &Config{}}
+	a.config.Health.Enabled = true
+	routes := []*Route{{Dst: &net.IPNet{IP: net.IP{52, 94, 0, 0}, Mask: net.CIDRMask(24, 32)}, Device: "wg0"}}
+
+	if got := a.failover(routes); len(got) != 1 || got[0].Type != "" {
+		t.Errorf("Expected the route to be kept while wg0 is up got %v", got)
+	}
+
+	a.health.recordLink("wg0", errors.New("down"))
+	a.config.Health.Fallback = "blackhole"
+	if got := a.failover(routes); len(got) != 1 || got[0].String() != "blackhole 52.94.0.0/24 table 0" {
+		t.Errorf("Expected a blackhole once wg0 is down got %v", got)
+	}
+
+	a.config.Health.Fallback, a.config.Health.Withdraw = "", true
+	if got := a.failover(routes); len(got) != 0 {
+		t.Errorf("Expected the route to be withdrawn once wg0 is down got %v", got)
+	}
+}
+
+func TestHealthPrune(t *testing.T) {
+	c := &Config{}
+	c.Health.Fall = 1
+	removed := HealthCheck{Gateway: net.ParseIP("10.0.0.1").To4()}
+	kept := HealthCheck{Gateway: net.ParseIP("10.0.0.2").To4()}
+	c.Health.Gateways = []HealthCheck{kept}
+
+	h := &healthState{}
+	h.record(c, removed, errors.New("timeout"))
+	h.record(c, kept, errors.New("timeout"))
+	h.prune(c)
+
+	if !h.healthy(removed.Gateway) {
+		t.Error("Expected a gateway that's no longer checked to be forgotten")
+	}
+	if h.healthy(kept.Gateway) {
+		t.Error("Expected a checked gateway to be remembered")
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	gateway := net.ParseIP("10.0.0.1").To4()
+	tests := []struct {
+		check   HealthCheck
+		target  string
+		address string
+	}{
+		{HealthCheck{Gateway: gateway, Probe: "icmp", Target: "52.94.1.1"}, "52.94.1.1", "52.94.1.1"},
+		{HealthCheck{Gateway: gateway, Probe: "tcp", Target: "52.94.1.1:443"}, "52.94.1.1", "52.94.1.1:443"},
+		{HealthCheck{Gateway: net.ParseIP("2001:db8::1"), Probe: "tcp", Target: "[2600:1f18::1]:443"}, "2600:1f18::1", "[2600:1f18::1]:443"},
+	}
+	for _, test := range tests {
+		target, address, err := probeTarget(test.check)
+		if err != nil || target.String() != test.target || address != test.address {
+			t.Errorf("Expected %s and %s for %+v got %s, %s, %v", test.target, test.address, test.check, target, address, err)
+		}
+	}
+
+	if _, _, err := probeTarget(HealthCheck{Gateway: gateway, Probe: "icmp", Target: "2600:1f18::1"}); err == nil {
+		t.Error("Expected a target of the other family to be refused")
+	}
+	if err := validateHealthCheck(HealthCheck{Gateway: gateway, Probe: "tcp", Target: "[2600:1f18::1]:443"}); err == nil {
+		t.Error("Expected a check with a target of the other family to be invalid")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errNoSnapshot = errors.New("no such snapshot")
+
+// PrefixChange is a prefix added or removed between two snapshots
+type PrefixChange struct {
+	Prefix             string
+	Region             string
+	NetworkBorderGroup string `json:",omitempty"`
+	Service            string
+}
+
+func (a *app) historyDir(s *source) string {
+	return a.store(filepath.Join("history", s.name))
+}
+
+// snapshotKey is the syncToken of the prefixes, sources that don't publish
+// one are keyed by when the cached copy was downloaded
+func (a *app) snapshotKey(s *source, prefixes *Prefixes) int64 {
+	if prefixes.SyncToken != 0 {
+		return prefixes.SyncToken
+	}
+	if stat, err := os.Stat(a.store(s.file)); err == nil {
+		return stat.ModTime().Unix()
+	}
+	return 0
+}
+
+// snapshot copies the cached copy of a source into its history, keeping
+// only the configured number of snapshots
+func (a *app) snapshot(s *source, prefixes *Prefixes) error {
+	if a.config.History < 1 {
+		return nil
+	}
+
+	key := a.snapshotKey(s, prefixes)
+	if key == 0 {
+		return nil
+	}
+
+	dir := a.historyDir(s)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, strconv.FormatInt(key, 10)+".json")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err := copyFile(a.store(s.file), file); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := a.snapshots(s)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > a.config.History {
+		os.Remove(filepath.Join(dir, strconv.FormatInt(snapshots[0], 10)+".json"))
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// snapshots lists the keys of every snapshot of a source, oldest first
+func (a *app) snapshots(s *source) ([]int64, error) {
+	f, err := os.Open(a.historyDir(s))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []int64
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		key, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
+func (a *app) loadSnapshot(s *source, key int64) (*Prefixes, error) {
+	prefixes, err := a.parseFile(s, filepath.Join(a.historyDir(s), strconv.FormatInt(key, 10)+".json"))
+	if os.IsNotExist(err) {
+		return nil, errNoSnapshot
+	}
+	return prefixes, err
+}
+
+// diffSnapshots reports the prefixes added and removed between two
+// snapshots of a source, only counting prefixes the selections would import
+func (a *app) diffSnapshots(s *source, from, to int64, selections []string) (added, removed []PrefixChange, err error) {
+	before, err := a.loadSnapshot(s, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := a.loadSnapshot(s, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added, removed = diffPrefixes(
+		mergePrefixes([]*source{{name: s.name, prefixes: before}}).Filter(selections),
+		mergePrefixes([]*source{{name: s.name, prefixes: after}}).Filter(selections),
+	)
+	return added, removed, nil
+}
+
+func diffPrefixes(before, after []Prefix) (added, removed []PrefixChange) {
+	index := func(prefixes []Prefix) map[string]Prefix {
+		m := make(map[string]Prefix, len(prefixes))
+		for _, v := range prefixes {
+			m[v.Prefix.String()] = v
+		}
+		return m
+	}
+	change := func(v Prefix) PrefixChange {
+		return PrefixChange{
+			Prefix:             v.Prefix.String(),
+			Region:             v.Region,
+			NetworkBorderGroup: v.NetworkBorderGroup,
+			Service:            v.Service,
+		}
+	}
+
+	had, has := index(before), index(after)
+	for k, v := range has {
+		if _, found := had[k]; !found {
+			added = append(added, change(v))
+		}
+	}
+	for k, v := range had {
+		if _, found := has[k]; !found {
+			removed = append(removed, change(v))
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].Prefix < added[j].Prefix })
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Prefix < removed[j].Prefix })
+	return added, removed
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to + ".tmp")
+		return err
+	}
+	return os.Rename(to+".tmp", to)
+}
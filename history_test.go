@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsrangenf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &app{
+		config: &Config{Store: dir, History: 2},
+		log:    log.New(ioutil.Discard, "", 0),
+	}
+	s, _ := newSource(SourceConfig{Name: defaultNamespace, Provider: defaultNamespace})
+
+	second := strings.NewReplacer("1531345951", "1531346000", "52.95.245.0/24", "52.95.246.0/24").Replace(sampleJson)
+	third := strings.NewReplacer("1531346000", "1531347000", "18.208.0.0/13", "18.216.0.0/13").Replace(second)
+	updates := []string{sampleJson, second, third}
+	for _, update := range updates {
+		prefixes, err := a.download(s, strings.NewReader(update))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		s.prefixes = prefixes
+	}
+
+	snapshots, err := a.snapshots(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expect := []int64{1531346000, 1531347000}; !reflect.DeepEqual(snapshots, expect) {
+		t.Errorf("Expected snapshots %v got %v", expect, snapshots)
+	}
+
+	added, removed, err := a.diffSnapshots(s, 1531346000, 1531347000, []string{"us-east-1:*"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(added) != 1 || added[0].Prefix != "18.216.0.0/13" {
+		t.Errorf("Expected 18.216.0.0/13 to be added got %v", added)
+	}
+	if len(removed) != 1 || removed[0].Prefix != "18.208.0.0/13" {
+		t.Errorf("Expected 18.208.0.0/13 to be removed got %v", removed)
+	}
+
+	added, removed, err = a.diffSnapshots(s, 1531346000, 1531347000, []string{"us-east-1:EC2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Expected no changes outside the selections got %v %v", added, removed)
+	}
+
+	if _, _, err := a.diffSnapshots(s, 1531345951, 1531347000, nil); err != errNoSnapshot {
+		t.Errorf("Expected a pruned snapshot to be missing got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// hash:net sets hold 65536 entries unless told otherwise
+const defaultIPSetMaxElements = 65536
+
+// ipsetLock keeps overlapping refreshes from sharing the temporary sets
+var ipsetLock sync.Mutex
+
+// setIPSets replaces the contents of the IPv4 and IPv6 hash:net sets with
+// the wanted routes. Each set is filled in a temporary set that's then
+// swapped with it, so iptables rules matching against it never see it half
+// populated.
+func setIPSets(a *app, routes []*Route) error {
+	cfg := a.config.IPSet
+	a.log.Println("Refreshing ipsets", cfg.Set4, "and", cfg.Set6)
+
+	ipsetLock.Lock()
+	defer ipsetLock.Unlock()
+
+	ipv4, ipv6 := splitFamilies(aggregateNetworks(destinations(routes)))
+	if err := swapIPSet(cfg.Set4, unix.NFPROTO_IPV4, ipv4); err != nil {
+		a.log.Println("Failed to write ipset", cfg.Set4, "due to", err)
+		return err
+	}
+	if err := swapIPSet(cfg.Set6, unix.NFPROTO_IPV6, ipv6); err != nil {
+		a.log.Println("Failed to write ipset", cfg.Set6, "due to", err)
+		return err
+	}
+
+	a.log.Printf("Programmed %d IPv4 and %d IPv6 prefixes into ipsets", len(ipv4), len(ipv6))
+	return nil
+}
+
+func swapIPSet(name string, family uint8, networks []*net.IPNet) error {
+	options := netlink.IpsetCreateOptions{Replace: true, Family: family, MaxElements: defaultIPSetMaxElements}
+	if n := uint32(len(networks)); n > options.MaxElements {
+		options.MaxElements = n
+	}
+
+	if err := netlink.IpsetCreate(name, "hash:net", options); err != nil {
+		return fmt.Errorf("create %s: %v", name, err)
+	}
+
+	tmp := name + "-tmp"
+	if err := netlink.IpsetCreate(tmp, "hash:net", options); err != nil {
+		return fmt.Errorf("create %s: %v", tmp, err)
+	}
+	defer netlink.IpsetDestroy(tmp)
+
+	// Left over from an earlier run that didn't get to finish
+	if err := netlink.IpsetFlush(tmp); err != nil {
+		return fmt.Errorf("flush %s: %v", tmp, err)
+	}
+
+	for _, v := range ipsetNetworks(networks) {
+		ones, _ := v.Mask.Size()
+		if err := netlink.IpsetAdd(tmp, &netlink.IPSetEntry{IP: v.IP, CIDR: uint8(ones), Replace: true}); err != nil {
+			return fmt.Errorf("add %s to %s: %v", v, tmp, err)
+		}
+	}
+
+	if err := netlink.IpsetSwap(tmp, name); err != nil {
+		return fmt.Errorf("swap %s with %s: %v", tmp, name, err)
+	}
+	return nil
+}
+
+// ipsetContents reads back the networks in the IPv4 and IPv6 sets, sets
+// that don't exist yet are empty
+func ipsetContents(a *app) ([]*net.IPNet, error) {
+	cfg := a.config.IPSet
+	results, err := netlink.IpsetListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+	for _, result := range results {
+		if result.SetName != cfg.Set4 && result.SetName != cfg.Set6 {
+			continue
+		}
+		for _, v := range result.Entries {
+			ip, bits := v.IP.To4(), 32
+			if ip == nil {
+				ip, bits = v.IP.To16(), 128
+			}
+			ones := int(v.CIDR)
+			if ones == 0 {
+				ones = bits
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)})
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,36 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+var pretendIPSets = map[string][]string{}
+
+// setIPSets pretends to program the sets because we're not in linux
+func setIPSets(a *app, routes []*Route) error {
+	ipv4, ipv6 := splitFamilies(aggregateNetworks(destinations(routes)))
+	for name, networks := range map[string][]*net.IPNet{a.config.IPSet.Set4: ipv4, a.config.IPSet.Set6: ipv6} {
+		pretendIPSets[name] = pretendIPSets[name][:0]
+		for _, v := range ipsetNetworks(networks) {
+			pretendIPSets[name] = append(pretendIPSets[name], v.String())
+		}
+	}
+	return nil
+}
+
+// ipsetContents returns the pretend sets
+func ipsetContents(a *app) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, name := range []string{a.config.IPSet.Set4, a.config.IPSet.Set6} {
+		for _, v := range pretendIPSets[name] {
+			_, network, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
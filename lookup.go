@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"sort"
+)
+
+// prefixTrie is a binary trie of networks for longest prefix matching
+type prefixTrie struct {
+	v4, v6 trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	entries  []int
+}
+
+func (t *prefixTrie) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (t *prefixTrie) insert(network *net.IPNet, entry int) {
+	node, ip := t.root(network.IP)
+	ones, bits := network.Mask.Size()
+	if len(ip)*8 != bits {
+		return
+	}
+
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	node.entries = append(node.entries, entry)
+}
+
+// lookup returns every entry with a network containing the ip, the most
+// specific networks first
+func (t *prefixTrie) lookup(ip net.IP) []int {
+	node, ip := t.root(ip)
+	if ip == nil {
+		return nil
+	}
+
+	var found []int
+	for i := 0; node != nil; i++ {
+		found = append(append([]int(nil), node.entries...), found...)
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bit(ip, i)]
+	}
+	return found
+}
+
+// Lookup returns every prefix containing the ip, the most specific first
+func (p *Prefixes) Lookup(ip net.IP) []Prefix {
+	p.indexOnce.Do(func() {
+		p.index = &prefixTrie{}
+		for i, v := range p.PrefixList {
+			p.index.insert(v.Prefix, i)
+		}
+	})
+
+	var found []Prefix
+	for _, i := range p.index.lookup(ip) {
+		found = append(found, p.PrefixList[i])
+	}
+	return found
+}
+
+// customIndex is the custom routes indexed by their networks
+type customIndex struct {
+	prefixTrie
+	customs []*CustomRoute
+}
+
+func indexCustoms(customs []*CustomRoute) *customIndex {
+	index := &customIndex{customs: customs}
+	for i, v := range customs {
+		index.insert(v.IPNet, i)
+	}
+	return index
+}
+
+// setCustoms replaces the custom routes and their index
+func (a *app) setCustoms(customs []*CustomRoute) {
+	a.customs, a.customIndex = customs, indexCustoms(customs)
+}
+
+// selectedBy returns the selection that imports the prefix, if any
+func selectedBy(with []string, prefix Prefix) string {
+	var selected string
+	for _, v := range with {
+		sel, err := ParseSelector(v)
+		if err != nil || !sel.Match(prefix) {
+			continue
+		}
+		if sel.Negate {
+			return ""
+		}
+		if selected == "" {
+			selected = v
+		}
+	}
+	return selected
+}
+
+// LookupMatch is a prefix containing the address that was looked up
+type LookupMatch struct {
+	Prefix             string
+	Custom             bool   `json:",omitempty"`
+	Provider           string `json:",omitempty"`
+	Region             string `json:",omitempty"`
+	NetworkBorderGroup string `json:",omitempty"`
+	Service            string `json:",omitempty"`
+	Selection          string `json:",omitempty"`
+}
+
+// LookupResult describes what's known about an address
+type LookupResult struct {
+	IP      string
+	Matches []LookupMatch
+	Route   string `json:",omitempty"`
+}
+
+func (a *app) lookup(ip net.IP) LookupResult {
+	result := LookupResult{IP: ip.String(), Matches: []LookupMatch{}}
+
+	index := a.customIndex
+	if index == nil {
+		index = indexCustoms(a.customs)
+	}
+
+	var lengths []int
+	for _, i := range index.lookup(ip) {
+		v := index.customs[i]
+		ones, _ := v.IPNet.Mask.Size()
+		lengths = append(lengths, ones)
+		result.Matches = append(result.Matches, LookupMatch{Prefix: v.IPNet.String(), Custom: true})
+	}
+
+	for _, v := range a.mergedPrefixes().Lookup(ip) {
+		ones, _ := v.Prefix.Mask.Size()
+		lengths = append(lengths, ones)
+		result.Matches = append(result.Matches, LookupMatch{
+			Prefix:             v.Prefix.String(),
+			Provider:           v.Namespace(),
+			Region:             v.Region,
+			NetworkBorderGroup: v.NetworkBorderGroup,
+			Service:            v.Service,
+			Selection:          selectedBy(a.selections, v),
+		})
+	}
+
+	sort.Stable(byLength{lengths, result.Matches})
+
+	// The most specific route is the one the kernel would use
+	best := -1
+	for _, v := range a.wantedRoutes() {
+		if ones, _ := v.Mask.Size(); v.Contains(ip) && ones > best {
+			best, result.Route = ones, v.String()
+		}
+	}
+
+	return result
+}
+
+// byLength sorts matches most specific first, keeping customs ahead of
+// imported prefixes of the same length
+type byLength struct {
+	lengths []int
+	matches []LookupMatch
+}
+
+func (b byLength) Len() int           { return len(b.lengths) }
+func (b byLength) Less(i, j int) bool { return b.lengths[i] > b.lengths[j] }
+func (b byLength) Swap(i, j int) {
+	b.lengths[i], b.lengths[j] = b.lengths[j], b.lengths[i]
+	b.matches[i], b.matches[j] = b.matches[j], b.matches[i]
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	prefixes := newPrefixes()
+	prefixes.addPrefix(Prefix{Prefix: network("52.94.0.0/15"), Region: "us-east-1", Service: "AMAZON"})
+	prefixes.addPrefix(Prefix{Prefix: network("52.95.245.0/24"), Region: "us-east-1", Service: "AMAZON"})
+	prefixes.addPrefix(Prefix{Prefix: network("52.95.245.0/24"), Region: "us-east-1", Service: "EC2"})
+	prefixes.addPrefix(Prefix{Prefix: network("18.208.0.0/13"), Region: "us-east-1", Service: "EC2"})
+	prefixes.addPrefix(Prefix{IPv6: true, Prefix: network("2600:1f18::/33"), Region: "us-east-1", Service: "EC2"})
+
+	a := &app{
+		config:     &Config{},
+		prefixes:   prefixes,
+		selections: []string{"us-east-1:EC2"},
+		customs:    []*CustomRoute{{IPNet: network("52.95.0.0/16")}},
+	}
+
+	got := a.lookup(net.ParseIP("52.95.245.10"))
+	expect := LookupResult{
+		IP: "52.95.245.10",
+		Matches: []LookupMatch{
+			{Prefix: "52.95.245.0/24", Provider: "aws", Region: "us-east-1", Service: "AMAZON"},
+			{Prefix: "52.95.245.0/24", Provider: "aws", Region: "us-east-1", Service: "EC2", Selection: "us-east-1:EC2"},
+			{Prefix: "52.95.0.0/16", Custom: true},
+			{Prefix: "52.94.0.0/15", Provider: "aws", Region: "us-east-1", Service: "AMAZON"},
+		},
+		Route: "52.95.245.0/24",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %+v got %+v", expect, got)
+	}
+
+	got = a.lookup(net.ParseIP("2600:1f18::1"))
+	if len(got.Matches) != 1 || got.Route != "2600:1f18::/33" {
+		t.Errorf("Expected the IPv6 prefix to match got %+v", got)
+	}
+
+	got = a.lookup(net.ParseIP("10.0.0.1"))
+	if len(got.Matches) != 0 || got.Route != "" {
+		t.Errorf("Expected no matches got %+v", got)
+	}
+}
+
+func TestTrieLookupCopies(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	trie := &prefixTrie{}
+	trie.insert(network("10.0.0.0/8"), 0)
+	for i := 1; i < 4; i++ {
+		trie.insert(network("10.1.0.0/16"), i)
+	}
+
+	found := trie.lookup(net.ParseIP("10.1.0.1"))
+	trie.insert(network("10.1.0.0/16"), 4)
+	if expect := []int{1, 2, 3, 0}; !reflect.DeepEqual(found, expect) {
+		t.Errorf("Expected %v got %v", expect, found)
+	}
+}
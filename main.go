@@ -37,6 +37,11 @@ func main() {
 		return
 	}
 
+	if flag.NArg() > 0 {
+		exitOnError(runCommand(cfg, flag.Args()))
+		return
+	}
+
 	app := &app{
 		config:     cfg,
 		configFile: *flgConfig,
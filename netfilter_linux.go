@@ -3,66 +3,569 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"sort"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
 
 var nfLock sync.Mutex
 
-func DefaultRoute() net.IP {
-	list, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+// DefaultRoute returns the gateway of the IPv4 or IPv6 default route and
+// the device it's reached through, IPv6 gateways are usually link-local
+// and mean nothing without it
+func DefaultRoute(ipv6 bool) (net.IP, string) {
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+	}
+
+	list, err := netlink.RouteList(nil, family)
 	if err != nil {
 		panic(err)
 	}
 
 	for _, route := range list {
-		if route.Dst == nil && route.Src == nil {
-			return route.Gw.To16()
+		if isDefault(route.Dst) && route.Src == nil && route.Gw != nil {
+			var device string
+			if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+				device = link.Attrs().Name
+			}
+			return route.Gw.To16(), device
 		}
 	}
 
-	return net.IP{}
+	return net.IP{}, ""
+}
+
+// isDefault reports if the destination is a default route, older kernels
+// and netlink versions leave it nil others report it as 0.0.0.0/0 or ::/0
+func isDefault(dst *net.IPNet) bool {
+	if dst == nil {
+		return true
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// defaultDst fills in the destination of a default route netlink left nil
+func defaultDst(family int, dst *net.IPNet) *net.IPNet {
+	if dst != nil {
+		return dst
+	}
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
 }
 
-func SetRoutes(a *app) error {
+// nfTables remembers every table routes have been programmed into so
+// routes are cleaned up when a selection moves to another table
+var nfTables = map[int]struct{}{}
+
+// linkIndexes caches interface indexes by name
+type linkIndexes map[string]int
+
+func (l linkIndexes) index(name string) (int, error) {
+	if idx, found := l[name]; found {
+		return idx, nil
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("device %s: %v", name, err)
+	}
+	l[name] = link.Attrs().Index
+	return l[name], nil
+}
+
+func (l linkIndexes) name(idx int) string {
+	for name, i := range l {
+		if i == idx {
+			return name
+		}
+	}
+	link, err := netlink.LinkByIndex(idx)
+	if err != nil {
+		return fmt.Sprintf("if%d", idx)
+	}
+	l[link.Attrs().Name] = idx
+	return link.Attrs().Name
+}
+
+func setKernelRoutes(a *app, routes []*Route) error {
 	a.log.Println("Refreshing netfilter routes")
 	nfLock.Lock()
 	defer nfLock.Unlock()
 
-	wanted := a.wantedRoutes()
-
-	existing, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: a.config.Route.Table}, netlink.RT_FILTER_TABLE)
+	plan, err := planRoutes(a, routes, a.wantedRules())
 	if err != nil {
-		a.log.Println("Failed to retrieve route list from netlink:", err)
 		return err
 	}
+	if len(plan.Foreign) > 0 || len(plan.ForeignRules) > 0 {
+		a.log.Printf("Leaving %d routes and %d rules that aren't ours alone", len(plan.Foreign), len(plan.ForeignRules))
+	}
 
-	for _, oldRoute := range existing {
-		idx := sort.Search(len(wanted), func(i int) bool {
-			return wanted[i].String() >= oldRoute.Dst.String()
-		})
-		if idx < len(wanted) && wanted[idx].String() == oldRoute.Dst.String() {
-			wanted = append(wanted[:idx], wanted[idx+1:]...)
-			continue
+	if err := applyPlan(a, plan); err != nil {
+		return err
+	}
+	a.applied = plan
+	return nil
+}
+
+// planKernelRoutes works out what programming the routes would change without
+// changing anything
+func planKernelRoutes(a *app, routes []*Route) (*Plan, error) {
+	nfLock.Lock()
+	defer nfLock.Unlock()
+	return planRoutes(a, routes, a.wantedRules())
+}
+
+func planRoutes(a *app, routes []*Route, rules []*Rule) (*Plan, error) {
+	plan := &Plan{tables: plannedTables(a, nfTables, routes, rules)}
+
+	var wanted4, wanted6 []*Route
+	for _, v := range routes {
+		if v.Dst.IP.To4() != nil {
+			wanted4 = append(wanted4, v)
+		} else {
+			wanted6 = append(wanted6, v)
+		}
+	}
+
+	var rules4, rules6 []*Rule
+	for _, v := range rules {
+		if v.IPv6 {
+			rules6 = append(rules6, v)
+		} else {
+			rules4 = append(rules4, v)
+		}
+	}
+
+	// IPv6 is always reconciled so routes are removed when it's turned off
+	links := linkIndexes{}
+	if err := planFamilyRoutes(a, plan, netlink.FAMILY_V4, wanted4, links); err != nil {
+		return nil, err
+	}
+	if err := planFamilyRoutes(a, plan, netlink.FAMILY_V6, wanted6, links); err != nil {
+		return nil, err
+	}
+
+	if !a.config.Route.ManageRules {
+		return plan, nil
+	}
+	if err := planFamilyRules(a, plan, netlink.FAMILY_V4, rules4); err != nil {
+		return nil, err
+	}
+	if err := planFamilyRules(a, plan, netlink.FAMILY_V6, rules6); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func planFamilyRoutes(a *app, plan *Plan, family int, wanted []*Route, links linkIndexes) error {
+	want := make(map[string]*Route, len(wanted))
+	for _, v := range wanted {
+		want[v.key()] = v
+	}
+
+	matched := map[string]struct{}{}
+	for table := range plan.tables {
+		existing, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			a.log.Println("Failed to retrieve route list from netlink:", err)
+			return err
 		}
-		netlink.RouteDel(&oldRoute)
+		planExistingRoutes(a, plan, family, existing, want, matched, links)
 	}
 
 	for _, v := range wanted {
-		err := netlink.RouteAdd(&netlink.Route{
-			Table: a.config.Route.Table,
-			Dst:   v,
-			Gw:    a.config.Route.actualGateway,
-		})
-		if err != nil && !os.IsExist(err) {
-			a.log.Printf("Failed write route %v to netlink: %v", v, err)
+		if _, found := matched[v.key()]; found {
+			continue
+		}
+		if _, err := toNetlink(v, links); err != nil {
 			return fmt.Errorf("%v: %v", v, err)
 		}
+		plan.Add = append(plan.Add, v)
+	}
+	return nil
+}
+
+// planExistingRoutes sorts the routes found in a table into the ones that
+// are already as wanted, ours to remove and foreign ones to leave alone
+func planExistingRoutes(a *app, plan *Plan, family int, existing []netlink.Route, want map[string]*Route, matched map[string]struct{}, links linkIndexes) {
+	for _, oldRoute := range existing {
+		// Default routes are left alone unless one is wanted, they're how
+		// everything else gets out
+		key := fmt.Sprintf("%d|%s", oldRoute.Table, defaultDst(family, oldRoute.Dst))
+		if _, found := want[key]; !found && isDefault(oldRoute.Dst) {
+			continue
+		}
+
+		if int(oldRoute.Protocol) != a.config.Route.Protocol {
+			plan.Foreign = append(plan.Foreign, fromNetlink(family, oldRoute, links))
+			continue
+		}
+
+		if v, found := want[key]; found {
+			if _, dupe := matched[key]; !dupe && sameRoute(family, v, oldRoute, links) {
+				matched[key] = struct{}{}
+				plan.Unchanged++
+				continue
+			}
+		}
+		plan.Remove = append(plan.Remove, fromNetlink(family, oldRoute, links))
+	}
+}
+
+// planFamilyRules works out the changes to the rules steering traffic into
+// the managed tables, any other rule of ours into those tables is removed
+func planFamilyRules(a *app, plan *Plan, family int, wanted []*Rule) error {
+	existing, err := netlink.RuleList(family)
+	if err != nil {
+		a.log.Println("Failed to retrieve rule list from netlink:", err)
+		return err
 	}
+	planExistingRules(a, plan, family, existing, wanted)
 	return nil
 }
+
+// planExistingRules sorts the rules into the managed tables into the ones
+// that are already as wanted, ours to remove and foreign ones to leave
+// alone, and adds the wanted ones that are missing
+func planExistingRules(a *app, plan *Plan, family int, existing []netlink.Rule, wanted []*Rule) {
+	matched := make([]bool, len(wanted))
+	for _, oldRule := range existing {
+		if _, managed := plan.tables[oldRule.Table]; !managed {
+			continue
+		}
+		if int(oldRule.Protocol) != a.config.Route.Protocol {
+			plan.ForeignRules = append(plan.ForeignRules, ruleFromNetlink(family, oldRule))
+			continue
+		}
+
+		found := false
+		for i, v := range wanted {
+			if !matched[i] && sameRule(ruleToNetlink(v), oldRule) {
+				matched[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			plan.RemoveRules = append(plan.RemoveRules, ruleFromNetlink(family, oldRule))
+		}
+	}
+
+	for i, v := range wanted {
+		if !matched[i] {
+			plan.AddRules = append(plan.AddRules, v)
+		}
+	}
+}
+
+// removeRules removes the rules of ours from the kernel, they're matched on
+// the priority of a configured rule and the protocol so rules belonging to
+// anything else are left alone
+func removeRules(a *app) error {
+	nfLock.Lock()
+	defer nfLock.Unlock()
+
+	priorities := map[int]struct{}{}
+	for _, v := range a.config.rules() {
+		priorities[v.Priority] = struct{}{}
+	}
+
+	var errs []string
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		existing, err := netlink.RuleList(family)
+		if err != nil {
+			a.log.Println("Failed to retrieve rule list from netlink:", err)
+			return err
+		}
+
+		for _, oldRule := range existing {
+			if _, found := priorities[oldRule.Priority]; !found || int(oldRule.Protocol) != a.config.Route.Protocol {
+				continue
+			}
+			rule := oldRule
+			if err := netlink.RuleDel(&rule); err != nil && err != syscall.ENOENT {
+				errs = append(errs, fmt.Sprintf("remove rule %v: %v", ruleFromNetlink(family, oldRule), err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// applyPlan makes the changes in the plan over netlink
+func applyPlan(a *app, plan *Plan) error {
+	for table := range plan.tables {
+		nfTables[table] = struct{}{}
+	}
+	return applyChanges(a, plan, netlinkChanger{links: linkIndexes{}})
+}
+
+// netlinkChanger makes the changes of a plan over netlink, routes and rules
+// that were read from the kernel are put back exactly as they were
+type netlinkChanger struct {
+	links linkIndexes
+}
+
+func (n netlinkChanger) RemoveRule(r *Rule) error {
+	if err := netlink.RuleDel(nativeRule(r)); err != syscall.ENOENT {
+		return err
+	}
+	return errUnchanged
+}
+
+func (n netlinkChanger) RemoveRoute(r *Route) error {
+	if err := netlink.RouteDel(nativeRoute(r)); err != syscall.ESRCH {
+		return err
+	}
+	return errUnchanged
+}
+
+func (n netlinkChanger) AddRoute(r *Route) error {
+	route, ok := r.native.(netlink.Route)
+	if !ok {
+		built, err := toNetlink(r, n.links)
+		if err != nil {
+			return err
+		}
+		route = *built
+	}
+	if err := netlink.RouteAdd(&route); !os.IsExist(err) {
+		return err
+	}
+	return errRouteConflict
+}
+
+func (n netlinkChanger) AddRule(r *Rule) error {
+	if err := netlink.RuleAdd(nativeRule(r)); !os.IsExist(err) {
+		return err
+	}
+	return errUnchanged
+}
+
+// nativeRoute is the route to ask the kernel to remove, exactly as it was
+// read when that's known
+func nativeRoute(r *Route) *netlink.Route {
+	if route, ok := r.native.(netlink.Route); ok {
+		return &route
+	}
+	return deleteNetlink(r)
+}
+
+// nativeRule is the rule to ask the kernel to remove, exactly as it was
+// read when that's known
+func nativeRule(r *Rule) *netlink.Rule {
+	if rule, ok := r.native.(netlink.Rule); ok {
+		return &rule
+	}
+	return ruleToNetlink(r)
+}
+
+// fromNetlink converts a route read from the kernel
+func fromNetlink(family int, r netlink.Route, links linkIndexes) *Route {
+	route := &Route{
+		Dst:      defaultDst(family, r.Dst),
+		Gateway:  r.Gw,
+		Metric:   r.Priority,
+		Table:    r.Table,
+		Protocol: int(r.Protocol),
+		Realm:    r.Realm,
+		native:   r,
+	}
+	for name, rtnType := range rtnTypes {
+		if r.Type == rtnType {
+			route.Type = name
+		}
+	}
+	if r.LinkIndex != 0 {
+		route.Device = links.name(r.LinkIndex)
+	}
+	for _, v := range r.MultiPath {
+		nexthop := Nexthop{Gateway: v.Gw, Weight: v.Hops + 1}
+		if v.LinkIndex != 0 {
+			nexthop.Device = links.name(v.LinkIndex)
+		}
+		route.Nexthops = append(route.Nexthops, nexthop)
+	}
+	return route
+}
+
+// deleteNetlink is enough of a route for the kernel to find it to delete
+func deleteNetlink(r *Route) *netlink.Route {
+	return &netlink.Route{
+		Table:    r.Table,
+		Dst:      r.Dst,
+		Gw:       r.Gateway,
+		Priority: r.Metric,
+		Protocol: netlink.RouteProtocol(r.Protocol),
+		Type:     rtnTypes[r.Type],
+	}
+}
+
+// ruleFromNetlink converts a rule read from the kernel
+func ruleFromNetlink(family int, r netlink.Rule) *Rule {
+	rule := &Rule{
+		IPv6:     family == netlink.FAMILY_V6,
+		Src:      r.Src,
+		Mark:     r.Mark,
+		IIF:      r.IifName,
+		Priority: r.Priority,
+		Table:    r.Table,
+		Protocol: int(r.Protocol),
+		native:   r,
+	}
+	if r.Mask != nil {
+		rule.Mask = *r.Mask
+	}
+	return rule
+}
+
+func ruleToNetlink(r *Rule) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	if r.IPv6 {
+		rule.Family = netlink.FAMILY_V6
+	}
+	rule.Src = r.Src
+	rule.IifName = r.IIF
+	rule.Priority = r.Priority
+	rule.Table = r.Table
+	rule.Protocol = uint8(r.Protocol)
+	if r.Mark != 0 {
+		mask := r.Mask
+		rule.Mark, rule.Mask = r.Mark, &mask
+	}
+	return rule
+}
+
+// sameRule reports if an existing rule is already programmed as wanted
+func sameRule(want *netlink.Rule, have netlink.Rule) bool {
+	var wantMask, haveMask uint32
+	if want.Mask != nil {
+		wantMask = *want.Mask
+	}
+	if have.Mask != nil {
+		haveMask = *have.Mask
+	}
+
+	var wantSrc, haveSrc string
+	if want.Src != nil {
+		wantSrc = want.Src.String()
+	}
+	if have.Src != nil {
+		haveSrc = have.Src.String()
+	}
+
+	return want.Priority == have.Priority && want.Table == have.Table &&
+		want.Mark == have.Mark && wantMask == haveMask &&
+		wantSrc == haveSrc && want.IifName == have.IifName &&
+		have.Dst == nil && have.OifName == "" && !have.Invert
+}
+
+// rtnTypes are the kernel's route types by name
+var rtnTypes = map[string]int{
+	"blackhole":   syscall.RTN_BLACKHOLE,
+	"unreachable": syscall.RTN_UNREACHABLE,
+	"prohibit":    syscall.RTN_PROHIBIT,
+}
+
+// toNetlink converts a route to what netlink needs to program it, routes
+// with next hops become multipath routes and device routes are link scoped
+func toNetlink(r *Route, links linkIndexes) (*netlink.Route, error) {
+	route := &netlink.Route{
+		Table:    r.Table,
+		Dst:      r.Dst,
+		Gw:       r.Gateway,
+		Priority: r.Metric,
+		Protocol: netlink.RouteProtocol(r.Protocol),
+		Realm:    r.Realm,
+	}
+	if r.Type != "" {
+		route.Type = rtnTypes[r.Type]
+		return route, nil
+	}
+	route.Type = syscall.RTN_UNICAST
+
+	if r.Device != "" {
+		idx, err := links.index(r.Device)
+		if err != nil {
+			return nil, err
+		}
+		route.LinkIndex = idx
+	}
+
+	if len(r.Nexthops) == 0 {
+		if r.Gateway == nil || r.Gateway.IsUnspecified() {
+			if r.Device != "" {
+				route.Gw, route.Scope = nil, netlink.SCOPE_LINK
+				return route, nil
+			}
+			return nil, errors.New("no gateway, is there a default route?")
+		}
+		return route, nil
+	}
+
+	route.Gw = nil
+	for _, v := range r.Nexthops {
+		nexthop := &netlink.NexthopInfo{
+			LinkIndex: route.LinkIndex,
+			Gw:        v.Gateway,
+			Hops:      v.Weight - 1,
+		}
+		if v.Device != "" {
+			idx, err := links.index(v.Device)
+			if err != nil {
+				return nil, err
+			}
+			nexthop.LinkIndex = idx
+		}
+		route.MultiPath = append(route.MultiPath, nexthop)
+	}
+	route.LinkIndex = 0
+	return route, nil
+}
+
+// ip6RoutePrioUser is the metric the kernel gives IPv6 routes added without
+// one
+const ip6RoutePrioUser = 1024
+
+// routeMetric is the metric the kernel keeps for a route added with it
+func routeMetric(family, metric int) int {
+	if family == netlink.FAMILY_V6 && metric == 0 {
+		return ip6RoutePrioUser
+	}
+	return metric
+}
+
+// sameRoute reports if an existing route is already programmed as wanted
+func sameRoute(family int, want *Route, have netlink.Route, links linkIndexes) bool {
+	route, err := toNetlink(want, links)
+	if err != nil || !have.Gw.Equal(route.Gw) || routeMetric(family, have.Priority) != routeMetric(family, route.Priority) || have.Realm != route.Realm || have.Type != route.Type {
+		return false
+	}
+	if route.LinkIndex != 0 && have.LinkIndex != route.LinkIndex {
+		return false
+	}
+
+	if len(have.MultiPath) != len(route.MultiPath) {
+		return false
+	}
+	for i, v := range route.MultiPath {
+		nexthop := have.MultiPath[i]
+		if !nexthop.Gw.Equal(v.Gw) || nexthop.Hops != v.Hops || v.LinkIndex != 0 && nexthop.LinkIndex != v.LinkIndex {
+			return false
+		}
+	}
+	return true
+}
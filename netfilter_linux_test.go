@@ -0,0 +1,122 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestPlanExistingRoutes(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+	gateway := net.ParseIP("10.0.0.1").To4()
+
+	a := &app{config: &Config{}}
+	a.config.Route.Table = 111
+	a.config.Route.Protocol = 175
+	a.config.Route.Realm = 7
+	a.config.Route.actualGateway = gateway
+
+	want := map[string]*Route{}
+	for _, v := range []string{"10.1.0.0/16", "10.3.0.0/16"} {
+		route := a.config.resolveRoute(network(v), RouteAttrs{})
+		want[route.key()] = route
+	}
+
+	existing := []netlink.Route{
+		{Table: 111, Dst: network("10.1.0.0/16"), Gw: gateway, Protocol: 175, Realm: 7, Type: syscall.RTN_UNICAST},
+		{Table: 111, Dst: network("10.2.0.0/16"), Gw: gateway, Protocol: 175, Realm: 7, Type: syscall.RTN_UNICAST},
+		{Table: 111, Dst: network("10.3.0.0/16"), Gw: gateway, Protocol: 175, Type: syscall.RTN_UNICAST},
+		{Table: 111, Dst: network("10.4.0.0/16"), Gw: gateway, Protocol: 3, Realm: 7, Type: syscall.RTN_UNICAST},
+		{Table: 111, Gw: net.ParseIP("10.0.0.254").To4(), Protocol: 175, Type: syscall.RTN_UNICAST},
+	}
+
+	plan := &Plan{}
+	matched := map[string]struct{}{}
+	planExistingRoutes(a, plan, netlink.FAMILY_V4, existing, want, matched, linkIndexes{})
+
+	var removed, foreign []string
+	for _, v := range plan.Remove {
+		removed = append(removed, v.Dst.String())
+	}
+	for _, v := range plan.Foreign {
+		foreign = append(foreign, v.Dst.String())
+	}
+
+	if plan.Unchanged != 1 {
+		t.Errorf("Expected 1 unchanged route got %d", plan.Unchanged)
+	}
+	if expect := []string{"10.2.0.0/16", "10.3.0.0/16"}; !reflect.DeepEqual(removed, expect) {
+		t.Errorf("Expected our stale and wrong realm routes %v to be removed got %v", expect, removed)
+	}
+	if expect := []string{"10.4.0.0/16"}; !reflect.DeepEqual(foreign, expect) {
+		t.Errorf("Expected the route with another protocol %v to be foreign got %v", expect, foreign)
+	}
+	if _, found := matched["111|10.3.0.0/16"]; found || len(matched) != 1 {
+		t.Errorf("Expected only the unchanged route to be matched got %v", matched)
+	}
+}
+
+func TestPlanExistingRoutesIPv6Metric(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("2600:1f18::/32")
+	gateway := net.ParseIP("2001:db8::1")
+
+	a := &app{config: &Config{}}
+	a.config.Route.Table = 111
+	a.config.Route.Protocol = 175
+	a.config.Route.actualGateway6 = gateway
+
+	route := a.config.resolveRoute(dst, RouteAttrs{})
+	want := map[string]*Route{route.key(): route}
+
+	// The kernel keeps IPv6 routes added without a metric at 1024
+	existing := []netlink.Route{{Table: 111, Dst: dst, Gw: gateway, Priority: 1024, Protocol: 175, Type: syscall.RTN_UNICAST}}
+	plan := &Plan{}
+	planExistingRoutes(a, plan, netlink.FAMILY_V6, existing, want, map[string]struct{}{}, linkIndexes{})
+	if plan.Unchanged != 1 || len(plan.Remove) != 0 {
+		t.Errorf("Expected the route to be unchanged got %+v", plan)
+	}
+}
+
+func TestPlanExistingRules(t *testing.T) {
+	_, src, _ := net.ParseCIDR("10.1.0.0/16")
+
+	a := &app{config: &Config{}}
+	a.config.Route.Protocol = 175
+	wanted := []*Rule{
+		{Src: src, Priority: 100, Table: 111, Protocol: 175},
+		{Priority: 110, Table: 111, Protocol: 175},
+	}
+
+	rule := func(src *net.IPNet, priority, table int, protocol uint8) netlink.Rule {
+		r := *netlink.NewRule()
+		r.Src, r.Priority, r.Table, r.Protocol = src, priority, table, protocol
+		return r
+	}
+	existing := []netlink.Rule{
+		rule(src, 100, 111, 175),
+		rule(nil, 120, 111, 175),
+		rule(nil, 100, 111, 0),
+		rule(nil, 100, 254, 175),
+	}
+
+	plan := &Plan{tables: map[int]struct{}{111: {}}}
+	planExistingRules(a, plan, netlink.FAMILY_V4, existing, wanted)
+
+	if len(plan.RemoveRules) != 1 || plan.RemoveRules[0].Priority != 120 {
+		t.Errorf("Expected our unwanted rule to be removed got %v", plan.RemoveRules)
+	}
+	if len(plan.ForeignRules) != 1 || plan.ForeignRules[0].Protocol != 0 {
+		t.Errorf("Expected the rule with another protocol to be foreign got %v", plan.ForeignRules)
+	}
+	if len(plan.AddRules) != 1 || plan.AddRules[0] != wanted[1] {
+		t.Errorf("Expected the missing rule to be added got %v", plan.AddRules)
+	}
+}
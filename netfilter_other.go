@@ -3,38 +3,164 @@
 package main
 
 import (
-	"bytes"
+	"fmt"
 	"net"
-	"sort"
 )
 
-var pretendRoutes = []*net.IPNet{}
+var pretendRoutes = []*Route{}
+var pretendRules = []*Rule{}
 
 // DefaultRoute returns a fake default route because we're not in linux
-func DefaultRoute() net.IP {
-	return net.IP{192, 168, 0, 1}
+func DefaultRoute(ipv6 bool) (net.IP, string) {
+	if ipv6 {
+		return net.ParseIP("fe80::1"), "eth0"
+	}
+	return net.IP{192, 168, 0, 1}, "eth0"
 }
 
-func SetRoutes(a *app) error {
-	wanted := a.wantedRoutes()
-	for i := 0; i < len(pretendRoutes); i++ {
-		oldRoute := pretendRoutes[i]
+// pretendFailures are the routes and rules the pretend kernel refuses to
+// change, by how they're written
+var pretendFailures = map[string]error{}
 
-		idx := sort.Search(len(wanted), func(i int) bool {
-			return bytes.Compare(wanted[i].IP, oldRoute.IP) >= 0 && bytes.Compare(wanted[i].Mask, oldRoute.Mask) >= 0
-		})
-		if idx < len(wanted) && bytes.Compare(wanted[idx].IP, oldRoute.IP) == 0 && bytes.Compare(wanted[idx].Mask, oldRoute.Mask) == 0 {
-			wanted = append(wanted[:idx], wanted[idx+1:]...)
-			continue
+// pretendChanges are the changes made to the pretend kernel, in order
+var pretendChanges []string
+
+func setKernelRoutes(a *app, routes []*Route) error {
+	plan, err := planKernelRoutes(a, routes)
+	if err != nil {
+		return err
+	}
+	if err := applyChanges(a, plan, pretendChanger{}); err != nil {
+		return err
+	}
+	a.applied = plan
+	return nil
+}
+
+// pretendChanger makes the changes of a plan to the pretend routes and rules
+type pretendChanger struct{}
+
+func (pretendChanger) change(what string, v fmt.Stringer) error {
+	if err := pretendFailures[v.String()]; err != nil {
+		return err
+	}
+	pretendChanges = append(pretendChanges, what+" "+v.String())
+	return nil
+}
+
+func (p pretendChanger) RemoveRule(r *Rule) error {
+	for i, v := range pretendRules {
+		if v.String() == r.String() {
+			if err := p.change("remove rule", r); err != nil {
+				return err
+			}
+			pretendRules = append(pretendRules[:i:i], pretendRules[i+1:]...)
+			return nil
 		}
-		pretendRoutes[i] = pretendRoutes[len(pretendRoutes)-1]
-		pretendRoutes = pretendRoutes[:len(pretendRoutes)-1]
-		i--
 	}
+	return errUnchanged
+}
+
+func (p pretendChanger) RemoveRoute(r *Route) error {
+	for i, v := range pretendRoutes {
+		if v.String() == r.String() {
+			if err := p.change("remove route", r); err != nil {
+				return err
+			}
+			pretendRoutes = append(pretendRoutes[:i:i], pretendRoutes[i+1:]...)
+			return nil
+		}
+	}
+	return errUnchanged
+}
 
-	for _, v := range wanted {
-		pretendRoutes = append(pretendRoutes, v)
+func (p pretendChanger) AddRoute(r *Route) error {
+	for _, v := range pretendRoutes {
+		if v.key() == r.key() {
+			return errRouteConflict
+		}
 	}
+	if err := p.change("add route", r); err != nil {
+		return err
+	}
+	pretendRoutes = append(pretendRoutes, r)
+	sortRoutes(pretendRoutes)
+	return nil
+}
 
+func (p pretendChanger) AddRule(r *Rule) error {
+	for _, v := range pretendRules {
+		if v.String() == r.String() {
+			return errUnchanged
+		}
+	}
+	if err := p.change("add rule", r); err != nil {
+		return err
+	}
+	pretendRules = append(pretendRules, r)
 	return nil
 }
+
+// removeRules removes the pretend rules of ours
+func removeRules(a *app) error {
+	priorities := map[int]struct{}{}
+	for _, v := range a.config.rules() {
+		priorities[v.Priority] = struct{}{}
+	}
+
+	kept := pretendRules[:0]
+	for _, v := range pretendRules {
+		if _, found := priorities[v.Priority]; !found || v.Protocol != a.config.Route.Protocol {
+			kept = append(kept, v)
+		}
+	}
+	pretendRules = kept
+	return nil
+}
+
+// planKernelRoutes works out what programming the routes would change without
+// changing anything
+func planKernelRoutes(a *app, routes []*Route) (*Plan, error) {
+	plan := &Plan{}
+
+	wanted := map[string]*Route{}
+	for _, v := range routes {
+		wanted[v.key()] = v
+	}
+
+	for _, oldRoute := range pretendRoutes {
+		if v, found := wanted[oldRoute.key()]; found && v.String() == oldRoute.String() {
+			delete(wanted, oldRoute.key())
+			plan.Unchanged++
+			continue
+		}
+		plan.Remove = append(plan.Remove, oldRoute)
+	}
+
+	for _, v := range routes {
+		if _, found := wanted[v.key()]; found {
+			plan.Add = append(plan.Add, v)
+		}
+	}
+
+	if a.config.Route.ManageRules {
+		wantedRules := map[string]struct{}{}
+		for _, v := range a.wantedRules() {
+			wantedRules[v.String()] = struct{}{}
+		}
+		for _, oldRule := range pretendRules {
+			if _, found := wantedRules[oldRule.String()]; found {
+				delete(wantedRules, oldRule.String())
+				continue
+			}
+			plan.RemoveRules = append(plan.RemoveRules, oldRule)
+		}
+		for _, v := range a.wantedRules() {
+			if _, found := wantedRules[v.String()]; found {
+				plan.AddRules = append(plan.AddRules, v)
+			}
+		}
+	}
+
+	return plan, nil
+}
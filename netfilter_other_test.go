@@ -0,0 +1,78 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func pretendRoute(s string) *Route {
+	_, dst, _ := net.ParseCIDR(s)
+	return &Route{Dst: dst, Gateway: net.ParseIP("10.0.0.1").To4(), Table: 111}
+}
+
+func TestSetKernelRoutesPartialFailure(t *testing.T) {
+	defer func() { pretendRoutes, pretendFailures, pretendChanges = nil, map[string]error{}, nil }()
+
+	a := &app{config: &Config{}, log: log.New(ioutil.Discard, "", 0)}
+	routes := []*Route{pretendRoute("10.1.0.0/16"), pretendRoute("10.2.0.0/16"), pretendRoute("10.3.0.0/16")}
+	pretendRoutes = nil
+	pretendFailures = map[string]error{routes[1].String(): errors.New("refused")}
+
+	err := setKernelRoutes(a, routes)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Expected the failed change to be reported got %v", err)
+	}
+	if a.applied != nil {
+		t.Error("Expected a failed plan not to be recorded as applied")
+	}
+
+	expect := []string{"add route " + routes[0].String(), "add route " + routes[2].String()}
+	if !reflect.DeepEqual(pretendChanges, expect) {
+		t.Errorf("Expected the other changes to be made %v got %v", expect, pretendChanges)
+	}
+}
+
+func TestSetKernelRoutesRollback(t *testing.T) {
+	defer func() { pretendRoutes, pretendFailures, pretendChanges = nil, map[string]error{}, nil }()
+
+	a := &app{config: &Config{}, log: log.New(ioutil.Discard, "", 0)}
+	a.config.Route.AllOrNothing = true
+
+	old := pretendRoute("10.9.0.0/16")
+	routes := []*Route{pretendRoute("10.1.0.0/16"), pretendRoute("10.2.0.0/16")}
+	pretendRoutes = []*Route{old}
+	pretendChanges = nil
+	pretendFailures = map[string]error{routes[1].String(): errors.New("refused")}
+
+	if err := setKernelRoutes(a, routes); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	expect := []string{
+		"remove route " + old.String(),
+		"add route " + routes[0].String(),
+		"remove route " + routes[0].String(),
+		"add route " + old.String(),
+	}
+	if !reflect.DeepEqual(pretendChanges, expect) {
+		t.Errorf("Expected the changes to be undone newest first %v got %v", expect, pretendChanges)
+	}
+	if len(pretendRoutes) != 1 || pretendRoutes[0] != old {
+		t.Errorf("Expected only the old route to be left got %v", pretendRoutes)
+	}
+
+	delete(pretendFailures, routes[1].String())
+	if err := setKernelRoutes(a, routes); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if a.applied == nil || len(a.applied.Add) != 2 {
+		t.Errorf("Expected the successful plan to be recorded got %+v", a.applied)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// intervalElement is a start or end element of an nftables interval set
+type intervalElement struct {
+	Key         net.IP
+	IntervalEnd bool
+}
+
+// intervalElements turns networks into the start and end elements of an
+// interval set, the end is the first address after the network and is left
+// off when the network runs to the end of the address space
+func intervalElements(networks []*net.IPNet) []intervalElement {
+	elements := make([]intervalElement, 0, len(networks)*2)
+	for _, v := range networks {
+		elements = append(elements, intervalElement{Key: v.IP})
+		if end := nextNetwork(v); end != nil {
+			elements = append(elements, intervalElement{Key: end, IntervalEnd: true})
+		}
+	}
+	return elements
+}
+
+// intervalNetworks turns the elements of an interval set back into the
+// networks covering them, a start without an end runs to the end of the
+// address space and an end without a start is ignored
+func intervalNetworks(elements []intervalElement, bits int) []*net.IPNet {
+	sorted := append([]intervalElement(nil), elements...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		// An interval ending where the next one starts closes first
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+
+	var networks []*net.IPNet
+	var start net.IP
+	for _, v := range sorted {
+		switch {
+		case !v.IntervalEnd:
+			start = v.Key
+		case start != nil:
+			networks = append(networks, rangeNetworks(start, v.Key, bits)...)
+			start = nil
+		}
+	}
+	if start != nil {
+		networks = append(networks, rangeNetworks(start, nil, bits)...)
+	}
+	return aggregateNetworks(networks)
+}
+
+// rangeNetworks returns the fewest networks covering start up to but not
+// including end, a nil end is the end of the address space
+func rangeNetworks(start, end net.IP, bits int) []*net.IPNet {
+	from := new(big.Int).SetBytes(start)
+	to := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	if end != nil {
+		to.SetBytes(end)
+	}
+
+	var networks []*net.IPNet
+	for from.Cmp(to) < 0 {
+		size := bits
+		if from.Sign() != 0 {
+			size = int(from.TrailingZeroBits())
+		}
+		for new(big.Int).Add(from, new(big.Int).Lsh(big.NewInt(1), uint(size))).Cmp(to) > 0 {
+			size--
+		}
+		networks = append(networks, &net.IPNet{IP: from.FillBytes(make(net.IP, bits/8)), Mask: net.CIDRMask(bits-size, bits)})
+		from.Add(from, new(big.Int).Lsh(big.NewInt(1), uint(size)))
+	}
+	return networks
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+)
+
+// setNftSets replaces the contents of the IPv4 and IPv6 named interval sets
+// with the wanted routes in a single batch, so rules matching against them
+// never see a half updated set
+func setNftSets(a *app, routes []*Route) error {
+	cfg := a.config.NFTables
+	a.log.Println("Refreshing nftables sets in table", cfg.Table)
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	ipv4, ipv6 := splitFamilies(aggregateNetworks(destinations(routes)))
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: cfg.Table})
+	for _, v := range []struct {
+		name     string
+		keyType  nftables.SetDatatype
+		networks []*net.IPNet
+	}{
+		{cfg.Set4, nftables.TypeIPAddr, ipv4},
+		{cfg.Set6, nftables.TypeIP6Addr, ipv6},
+	} {
+		set := &nftables.Set{Table: table, Name: v.name, KeyType: v.keyType, Interval: true}
+		if err := conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("set %s: %v", v.name, err)
+		}
+		conn.FlushSet(set)
+		var elements []nftables.SetElement
+		for _, element := range intervalElements(v.networks) {
+			elements = append(elements, nftables.SetElement{Key: element.Key, IntervalEnd: element.IntervalEnd})
+		}
+		if err := conn.SetAddElements(set, elements); err != nil {
+			return fmt.Errorf("set %s: %v", v.name, err)
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		a.log.Println("Failed to write nftables sets:", err)
+		return err
+	}
+	a.log.Printf("Programmed %d IPv4 and %d IPv6 prefixes into nftables", len(ipv4), len(ipv6))
+	return nil
+}
+
+// nftSetNetworks reads back the networks in the IPv4 and IPv6 sets, sets
+// that don't exist yet are empty
+func nftSetNetworks(a *app) ([]*net.IPNet, error) {
+	cfg := a.config.NFTables
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+	var table *nftables.Table
+	for _, v := range tables {
+		if v.Name == cfg.Table {
+			table = v
+		}
+	}
+	if table == nil {
+		return nil, nil
+	}
+
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %v", cfg.Table, err)
+	}
+	var networks []*net.IPNet
+	for _, set := range sets {
+		bits := 32
+		switch set.Name {
+		case cfg.Set4:
+		case cfg.Set6:
+			bits = 128
+		default:
+			continue
+		}
+		found, err := conn.GetSetElements(set)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %v", set.Name, err)
+		}
+		elements := make([]intervalElement, 0, len(found))
+		for _, v := range found {
+			elements = append(elements, intervalElement{Key: v.Key, IntervalEnd: v.IntervalEnd})
+		}
+		networks = append(networks, intervalNetworks(elements, bits)...)
+	}
+	return networks, nil
+}
@@ -0,0 +1,36 @@
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+var pretendSets = map[string][]string{}
+
+// setNftSets pretends to program the sets because we're not in linux
+func setNftSets(a *app, routes []*Route) error {
+	ipv4, ipv6 := splitFamilies(aggregateNetworks(destinations(routes)))
+	for name, networks := range map[string][]*net.IPNet{a.config.NFTables.Set4: ipv4, a.config.NFTables.Set6: ipv6} {
+		pretendSets[name] = pretendSets[name][:0]
+		for _, v := range networks {
+			pretendSets[name] = append(pretendSets[name], v.String())
+		}
+	}
+	return nil
+}
+
+// nftSetNetworks returns the pretend sets
+func nftSetNetworks(a *app) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, name := range []string{a.config.NFTables.Set4, a.config.NFTables.Set6} {
+		for _, v := range pretendSets[name] {
+			_, network, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,40 @@
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestSetSinksPlanAfterRestart(t *testing.T) {
+	a := &app{config: &Config{}, log: log.New(ioutil.Discard, "", 0)}
+	a.config.NFTables.Set4, a.config.NFTables.Set6 = "plan4", "plan6"
+	a.config.IPSet.Set4, a.config.IPSet.Set6 = "plan4", "plan6"
+	defer func() {
+		delete(pretendSets, "plan4")
+		delete(pretendSets, "plan6")
+		delete(pretendIPSets, "plan4")
+		delete(pretendIPSets, "plan6")
+	}()
+
+	routes := []*Route{pretendRoute("52.94.0.0/24"), pretendRoute("52.94.1.0/24")}
+	if err := setNftSets(a, routes); err != nil {
+		t.Fatal(err)
+	}
+	if err := setIPSets(a, routes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh sinks remember nothing, the plan has to come from the sets
+	for _, sink := range []Sink{&nftSink{a: a}, &ipsetSink{a: a}} {
+		plan, err := sink.Plan(append(routes, pretendRoute("52.94.4.0/24")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Add) != 1 || plan.Add[0].Dst.String() != "52.94.4.0/24" || len(plan.Remove) != 0 || plan.Unchanged != 1 {
+			t.Errorf("Expected to add 52.94.4.0/24 to the aggregate got %+v", plan)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIntervalElements(t *testing.T) {
+	tests := []struct {
+		input  []string
+		expect []string
+	}{
+		{
+			input:  []string{"10.0.0.0/24", "52.94.0.0/23"},
+			expect: []string{"10.0.0.0", "end 10.0.1.0", "52.94.0.0", "end 52.94.2.0"},
+		},
+		{
+			input:  []string{"255.255.255.0/24", "128.0.0.0/1"},
+			expect: []string{"255.255.255.0", "128.0.0.0"},
+		},
+		{
+			input:  []string{"2600:1f18::/32", "ffff::/16"},
+			expect: []string{"2600:1f18::", "end 2600:1f19::", "ffff::"},
+		},
+	}
+
+	for _, test := range tests {
+		var input []*net.IPNet
+		for _, v := range test.input {
+			_, n, _ := net.ParseCIDR(v)
+			input = append(input, n)
+		}
+		var got []string
+		for _, v := range intervalElements(input) {
+			if v.IntervalEnd {
+				got = append(got, "end "+net.IP(v.Key).String())
+			} else {
+				got = append(got, net.IP(v.Key).String())
+			}
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Expected %v got %v", test.expect, got)
+		}
+	}
+}
+
+func TestIntervalNetworks(t *testing.T) {
+	var input []*net.IPNet
+	for _, v := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24", "52.94.0.0/23", "255.255.255.0/24"} {
+		_, n, _ := net.ParseCIDR(v)
+		input = append(input, n)
+	}
+
+	// Read back in any order, with the stray end some nft versions add
+	elements := intervalElements(input)
+	for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+		elements[i], elements[j] = elements[j], elements[i]
+	}
+	elements = append(elements, intervalElement{Key: net.IPv4zero.To4(), IntervalEnd: true})
+
+	var got []string
+	for _, v := range intervalNetworks(elements, 32) {
+		got = append(got, v.String())
+	}
+	expect := []string{"10.0.0.0/23", "10.0.3.0/24", "52.94.0.0/23", "255.255.255.0/24"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+}
+
+func TestRangeNetworks(t *testing.T) {
+	got := []string{}
+	for _, v := range rangeNetworks(net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.8").To4(), 32) {
+		got = append(got, v.String())
+	}
+	if expect := []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+
+	if got := rangeNetworks(net.ParseIP("::"), nil, 128); len(got) != 1 || got[0].String() != "::/0" {
+		t.Errorf("Expected ::/0 got %v", got)
+	}
+}
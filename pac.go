@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const defaultPACPath = "/proxy.pac"
+
+var pacKeywords = []string{"PROXY ", "HTTPS ", "SOCKS ", "SOCKS4 ", "SOCKS5 ", "DIRECT"}
+
+func validatePAC(c *Config) error {
+	if c.PAC.Path == "" {
+		c.PAC.Path = defaultPACPath
+	}
+	if !c.PAC.Enabled {
+		return nil
+	}
+
+	if !strings.HasPrefix(c.PAC.Path, "/") || strings.HasPrefix(c.PAC.Path, "/api/") || strings.HasPrefix(c.PAC.Path, "/hook/") || c.PAC.Path == "/" {
+		return fmt.Errorf("pac path %q must start with / and not clash with the api", c.PAC.Path)
+	}
+	if c.PAC.Proxy == "" {
+		return errors.New("pac needs a proxy")
+	}
+	if strings.ContainsAny(c.PAC.Proxy, "\"\\\r\n") {
+		return fmt.Errorf("invalid pac proxy %q", c.PAC.Proxy)
+	}
+	return nil
+}
+
+// pacProxy is the proxy as a PAC result, a bare host:port is an HTTP proxy
+func pacProxy(proxy string) string {
+	for _, v := range pacKeywords {
+		if strings.HasPrefix(strings.ToUpper(proxy), v) {
+			return proxy
+		}
+	}
+	return "PROXY " + proxy
+}
+
+// renderPAC writes a proxy auto-config script sending destinations inside
+// the networks to the proxy and everything else direct. IPv6 networks are
+// only checked by browsers with the isInNetEx extension.
+func renderPAC(w io.Writer, proxy string, networks []*net.IPNet) {
+	ipv4, ipv6 := splitFamilies(networks)
+	proxy = pacProxy(proxy)
+
+	fmt.Fprintln(w, "// Generated by awsrangenf")
+	fmt.Fprintln(w, "function FindProxyForURL(url, host) {")
+	if len(ipv4) > 0 {
+		fmt.Fprintln(w, "\tvar ip = dnsResolve(host);")
+		fmt.Fprint(w, "\tif (ip && (")
+		for i, v := range ipv4 {
+			if i > 0 {
+				fmt.Fprint(w, " ||\n\t\t")
+			}
+			fmt.Fprintf(w, "isInNet(ip, %q, %q)", v.IP.String(), net.IP(v.Mask).String())
+		}
+		fmt.Fprintf(w, ")) {\n\t\treturn %q;\n\t}\n", proxy)
+	}
+	if len(ipv6) > 0 {
+		fmt.Fprintln(w, "\tif (typeof dnsResolveEx == \"function\" && typeof isInNetEx == \"function\") {")
+		fmt.Fprintln(w, "\t\tvar ips = dnsResolveEx(host).split(\";\");")
+		fmt.Fprintln(w, "\t\tfor (var i = 0; i < ips.length; i++) {")
+		fmt.Fprint(w, "\t\t\tif (ips[i] && (")
+		for i, v := range ipv6 {
+			if i > 0 {
+				fmt.Fprint(w, " ||\n\t\t\t\t")
+			}
+			fmt.Fprintf(w, "isInNetEx(ips[i], %q)", v.String())
+		}
+		fmt.Fprintf(w, ")) {\n\t\t\t\treturn %q;\n\t\t\t}\n\t\t}\n\t}\n", proxy)
+	}
+	fmt.Fprintln(w, "\treturn \"DIRECT\";")
+	fmt.Fprintln(w, "}")
+}
+
+// pacCache is the rendered PAC file, it's thrown away whenever the routes
+// might have changed
+type pacCache struct {
+	sync.Mutex
+	generation int
+	rendered   []byte
+}
+
+// invalidatePAC throws away the rendered PAC file
+func (a *app) invalidatePAC() {
+	a.pac.Lock()
+	defer a.pac.Unlock()
+	a.pac.generation++
+	a.pac.rendered = nil
+}
+
+// renderedPAC returns the PAC file for the routes, rendering it if it was
+// thrown away. A render that raced an invalidation isn't kept
+func (a *app) renderedPAC() []byte {
+	a.pac.Lock()
+	rendered, generation := a.pac.rendered, a.pac.generation
+	a.pac.Unlock()
+	if rendered != nil {
+		return rendered
+	}
+
+	var buf bytes.Buffer
+	renderPAC(&buf, a.config.PAC.Proxy, aggregateNetworks(a.wantedRoutes()))
+
+	a.pac.Lock()
+	defer a.pac.Unlock()
+	if a.pac.generation == generation {
+		a.pac.rendered = buf.Bytes()
+	}
+	return buf.Bytes()
+}
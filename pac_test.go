@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRenderPAC(t *testing.T) {
+	var networks []*net.IPNet
+	for _, v := range []string{"52.94.0.0/23", "52.95.0.0/24", "2600:1f18::/32"} {
+		_, n, _ := net.ParseCIDR(v)
+		networks = append(networks, n)
+	}
+
+	var buf bytes.Buffer
+	renderPAC(&buf, "proxy.example.com:3128", networks)
+	expect := `// Generated by awsrangenf
+function FindProxyForURL(url, host) {
+	var ip = dnsResolve(host);
+	if (ip && (isInNet(ip, "52.94.0.0", "255.255.254.0") ||
+		isInNet(ip, "52.95.0.0", "255.255.255.0"))) {
+		return "PROXY proxy.example.com:3128";
+	}
+	if (typeof dnsResolveEx == "function" && typeof isInNetEx == "function") {
+		var ips = dnsResolveEx(host).split(";");
+		for (var i = 0; i < ips.length; i++) {
+			if (ips[i] && (isInNetEx(ips[i], "2600:1f18::/32"))) {
+				return "PROXY proxy.example.com:3128";
+			}
+		}
+	}
+	return "DIRECT";
+}
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expect, got)
+	}
+
+	buf.Reset()
+	renderPAC(&buf, "SOCKS5 10.0.0.1:1080", nil)
+	if expect := "// Generated by awsrangenf\nfunction FindProxyForURL(url, host) {\n\treturn \"DIRECT\";\n}\n"; buf.String() != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expect, buf.String())
+	}
+	if got := pacProxy("SOCKS5 10.0.0.1:1080"); got != "SOCKS5 10.0.0.1:1080" {
+		t.Errorf("Expected the proxy left alone got %q", got)
+	}
+}
+
+func TestRenderedPACCached(t *testing.T) {
+	_, network, _ := net.ParseCIDR("52.94.0.0/24")
+	a := &app{config: &Config{}, prefixes: newPrefixes()}
+	a.config.PAC.Proxy = "proxy.example.com:3128"
+
+	empty := a.renderedPAC()
+	a.setCustoms([]*CustomRoute{{IPNet: network}})
+	if got := a.renderedPAC(); !bytes.Equal(got, empty) {
+		t.Errorf("Expected the cached PAC file until it's invalidated got:\n%s", got)
+	}
+
+	a.invalidatePAC()
+	if got := a.renderedPAC(); !bytes.Contains(got, []byte(`isInNet(ip, "52.94.0.0", "255.255.255.0")`)) {
+		t.Errorf("Expected the custom route once invalidated got:\n%s", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Plan is what has to change in the kernel to program the wanted routes
+// and rules, it's worked out before anything is touched so it can be shown
+// without being applied
+type Plan struct {
+	Add         []*Route
+	Remove      []*Route
+	AddRules    []*Rule `json:",omitempty"`
+	RemoveRules []*Rule `json:",omitempty"`
+	Unchanged   int
+
+	// Foreign routes and rules weren't programmed by us, they're reported
+	// but never touched
+	Foreign      []*Route `json:",omitempty"`
+	ForeignRules []*Rule  `json:",omitempty"`
+
+	// Sinks are the plans for every other enabled sink, by name
+	Sinks map[string]*Plan `json:",omitempty"`
+
+	// tables are every table the plan manages
+	tables map[int]struct{}
+}
+
+// errUnchanged is returned by a planChanger when there was nothing to
+// change, eg. the route was already removed by someone else
+var errUnchanged = errors.New("unchanged")
+
+// errRouteConflict is returned by a planChanger when a route that isn't
+// ours is already where a route is being added
+var errRouteConflict = errors.New("conflicts with a route that isn't ours")
+
+// planChanger makes the changes of a plan one at a time
+type planChanger interface {
+	RemoveRule(r *Rule) error
+	RemoveRoute(r *Route) error
+	AddRoute(r *Route) error
+	AddRule(r *Rule) error
+}
+
+// applyChanges makes the changes in the plan, stale routes and rules go
+// first. Every failure is collected rather than stopping at the first, and
+// when all or nothing is configured a failed apply puts back everything
+// that had already changed, the most recent change first.
+func applyChanges(a *app, plan *Plan, c planChanger) error {
+	var errs []string
+	var undo []func() error
+	fail := func(what string, v fmt.Stringer, err error) {
+		a.log.Printf("Failed to %s %v: %v", what, v, err)
+		errs = append(errs, fmt.Sprintf("%s %v: %v", what, v, err))
+	}
+
+	for _, v := range plan.RemoveRules {
+		if err := c.RemoveRule(v); err != nil {
+			if err != errUnchanged {
+				fail("remove rule", v, err)
+			}
+			continue
+		}
+		rule := v
+		undo = append(undo, func() error { return c.AddRule(rule) })
+	}
+
+	for _, v := range plan.Remove {
+		if err := c.RemoveRoute(v); err != nil {
+			if err != errUnchanged {
+				fail("remove route", v, err)
+			}
+			continue
+		}
+		route := v
+		undo = append(undo, func() error { return c.AddRoute(route) })
+	}
+
+	for _, v := range plan.Add {
+		if err := c.AddRoute(v); err != nil {
+			if err != errUnchanged {
+				fail("add route", v, err)
+			}
+			continue
+		}
+		route := v
+		undo = append(undo, func() error { return c.RemoveRoute(route) })
+	}
+
+	for _, v := range plan.AddRules {
+		if err := c.AddRule(v); err != nil {
+			if err != errUnchanged {
+				fail("add rule", v, err)
+			}
+			continue
+		}
+		rule := v
+		undo = append(undo, func() error { return c.RemoveRule(rule) })
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if a.config.Route.AllOrNothing {
+		a.log.Println("Rolling back", len(undo), "route and rule changes")
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil && err != errUnchanged {
+				a.log.Println("Failed to roll back:", err)
+				errs = append(errs, fmt.Sprintf("rollback: %v", err))
+			}
+		}
+	}
+
+	return fmt.Errorf("%d of %d route and rule changes failed:\n%s", len(errs), len(plan.Add)+len(plan.Remove)+len(plan.AddRules)+len(plan.RemoveRules), strings.Join(errs, "\n"))
+}
+
+// Empty reports if there's nothing to change
+func (p *Plan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Remove) == 0 && len(p.AddRules) == 0 && len(p.RemoveRules) == 0
+}
+
+// plannedTables is every table that's already managed or is about to be
+func plannedTables(a *app, managed map[int]struct{}, routes []*Route, rules []*Rule) map[int]struct{} {
+	tables := map[int]struct{}{a.config.Route.Table: {}}
+	for table := range managed {
+		tables[table] = struct{}{}
+	}
+	for _, v := range routes {
+		tables[v.Table] = struct{}{}
+	}
+	for _, v := range rules {
+		tables[v.Table] = struct{}{}
+	}
+	return tables
+}
+
+// wantedRules is every ip rule that should be programmed, none when rules
+// aren't managed
+func (a *app) wantedRules() []*Rule {
+	if !a.config.Route.ManageRules {
+		return nil
+	}
+	return a.config.rules()
+}
+
+func (r *Route) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Rule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
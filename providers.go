@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultNamespace is the selection namespace assumed when a selection
+// doesn't name one, it's where the original AWS ranges live
+const defaultNamespace = "aws"
+
+// globalRegion is used for providers that don't publish regional ranges
+const globalRegion = "global"
+
+// Provider knows how to turn a published range list into Prefixes
+type Provider interface {
+	// DefaultURL is where the provider publishes its ranges
+	DefaultURL() string
+	// Parse reads the range list, ignoring IPv6 prefixes unless asked for them
+	Parse(ipv6 bool, r io.Reader) (*Prefixes, error)
+}
+
+var providers = map[string]Provider{
+	"aws":        awsProvider{},
+	"gcp":        gcpProvider{},
+	"azure":      azureProvider{},
+	"cloudflare": cloudflareProvider{},
+	"github":     githubProvider{},
+	"oracle":     oracleProvider{},
+}
+
+// parseNetwork parses a CIDR and reports if it should be kept
+func parseNetwork(ipv6 bool, cidr string) (prefix Prefix, keep bool, err error) {
+	_, prefix.Prefix, err = net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return prefix, false, err
+	}
+	prefix.IPv6 = prefix.Prefix.IP.To4() == nil
+	return prefix, ipv6 || !prefix.IPv6, nil
+}
+
+type awsProvider struct{}
+
+func (awsProvider) DefaultURL() string {
+	return "https://ip-ranges.amazonaws.com/ip-ranges.json"
+}
+
+func (awsProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	return ParseAWSIPRanges(ipv6, r)
+}
+
+// gcpProvider reads the Google Cloud cloud.json, scopes are used as regions
+type gcpProvider struct{}
+
+func (gcpProvider) DefaultURL() string {
+	return "https://www.gstatic.com/ipranges/cloud.json"
+}
+
+func (gcpProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	var doc struct {
+		SyncToken    string `json:"syncToken"`
+		CreationTime string `json:"creationTime"`
+		Prefixes     []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	prefixes := newPrefixes()
+	if doc.SyncToken != "" {
+		token, err := strconv.ParseInt(doc.SyncToken, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		prefixes.SyncToken = token
+	}
+	if doc.CreationTime != "" {
+		created, err := time.Parse("2006-01-02T15:04:05.999999", doc.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+		prefixes.CreateDate = created
+	}
+
+	for _, v := range doc.Prefixes {
+		cidr := v.IPv4Prefix
+		if cidr == "" {
+			cidr = v.IPv6Prefix
+		}
+		prefix, keep, err := parseNetwork(ipv6, cidr)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			prefix.Region, prefix.Service = v.Scope, v.Service
+			prefixes.addPrefix(prefix)
+		}
+	}
+
+	prefixes.sortLookups()
+	return prefixes, nil
+}
+
+// azureProvider reads the Azure service tags download, the part of the tag
+// name before the dot is used as the service
+type azureProvider struct{}
+
+func (azureProvider) DefaultURL() string {
+	return "https://download.microsoft.com/download/7/1/D/71D86715-5596-4529-9B13-DA13A5DE5B63/ServiceTags_Public.json"
+}
+
+func (azureProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	var doc struct {
+		ChangeNumber int64 `json:"changeNumber"`
+		Values       []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	prefixes := newPrefixes()
+	prefixes.SyncToken = doc.ChangeNumber
+
+	for _, v := range doc.Values {
+		region := v.Properties.Region
+		if region == "" {
+			region = globalRegion
+		}
+		service := strings.SplitN(v.Name, ".", 2)[0]
+		for _, cidr := range v.Properties.AddressPrefixes {
+			prefix, keep, err := parseNetwork(ipv6, cidr)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				prefix.Region, prefix.Service = region, service
+				prefixes.addPrefix(prefix)
+			}
+		}
+	}
+
+	prefixes.sortLookups()
+	return prefixes, nil
+}
+
+// cloudflareProvider reads either the Cloudflare API ips response or one of
+// the plain text ips-v4/ips-v6 lists
+type cloudflareProvider struct{}
+
+func (cloudflareProvider) DefaultURL() string {
+	return "https://api.cloudflare.com/client/v4/ips"
+}
+
+func (cloudflareProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cidrs []string
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var doc struct {
+			Result struct {
+				IPv4CIDRs []string `json:"ipv4_cidrs"`
+				IPv6CIDRs []string `json:"ipv6_cidrs"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return nil, err
+		}
+		cidrs = append(doc.Result.IPv4CIDRs, doc.Result.IPv6CIDRs...)
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				cidrs = append(cidrs, line)
+			}
+		}
+	}
+
+	prefixes := newPrefixes()
+	for _, cidr := range cidrs {
+		prefix, keep, err := parseNetwork(ipv6, cidr)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			prefix.Region, prefix.Service = globalRegion, "CLOUDFLARE"
+			prefixes.addPrefix(prefix)
+		}
+	}
+
+	prefixes.sortLookups()
+	return prefixes, nil
+}
+
+// githubProvider reads the GitHub /meta API, every list of networks it
+// publishes (hooks, web, api, actions...) is treated as a service
+type githubProvider struct{}
+
+func (githubProvider) DefaultURL() string {
+	return "https://api.github.com/meta"
+}
+
+func (githubProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	services := make([]string, 0, len(doc))
+	for k := range doc {
+		services = append(services, k)
+	}
+	sort.Strings(services)
+
+	prefixes := newPrefixes()
+	for _, service := range services {
+		var cidrs []string
+		if err := json.Unmarshal(doc[service], &cidrs); err != nil {
+			// Not a list of networks, there's plenty of other metadata in there
+			continue
+		}
+		for _, cidr := range cidrs {
+			prefix, keep, err := parseNetwork(ipv6, cidr)
+			if err != nil {
+				// Lists of things that aren't networks, like domains
+				break
+			}
+			if keep {
+				prefix.Region, prefix.Service = globalRegion, service
+				prefixes.addPrefix(prefix)
+			}
+		}
+	}
+
+	prefixes.sortLookups()
+	return prefixes, nil
+}
+
+// oracleProvider reads the Oracle Cloud public_ip_ranges.json, each tag on
+// a network is treated as a service
+type oracleProvider struct{}
+
+func (oracleProvider) DefaultURL() string {
+	return "https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges.json"
+}
+
+func (oracleProvider) Parse(ipv6 bool, r io.Reader) (*Prefixes, error) {
+	var doc struct {
+		LastUpdated string `json:"last_updated_timestamp"`
+		Regions     []struct {
+			Region string `json:"region"`
+			CIDRs  []struct {
+				CIDR string   `json:"cidr"`
+				Tags []string `json:"tags"`
+			} `json:"cidrs"`
+		} `json:"regions"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	prefixes := newPrefixes()
+	if doc.LastUpdated != "" {
+		updated, err := time.Parse("2006-01-02T15:04:05.999999", doc.LastUpdated)
+		if err != nil {
+			return nil, err
+		}
+		prefixes.SyncToken = updated.Unix()
+		prefixes.CreateDate = updated
+	}
+
+	for _, region := range doc.Regions {
+		for _, v := range region.CIDRs {
+			prefix, keep, err := parseNetwork(ipv6, v.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+			prefix.Region = region.Region
+			for _, tag := range v.Tags {
+				prefix.Service = tag
+				prefixes.addPrefix(prefix)
+			}
+		}
+	}
+
+	prefixes.sortLookups()
+	return prefixes, nil
+}
+
+// mergePrefixes combines the prefixes from every source, lookups for
+// anything outside the default namespace are keyed as namespace:name
+func mergePrefixes(sources []*source) *Prefixes {
+	merged := newPrefixes()
+	for _, s := range sources {
+		if s.prefixes == nil {
+			continue
+		}
+
+		if s.name == defaultNamespace {
+			merged.SyncToken = s.prefixes.SyncToken
+			merged.CreateDate = s.prefixes.CreateDate
+		}
+
+		for _, prefix := range s.prefixes.PrefixList {
+			prefix.Provider = s.name
+			merged.PrefixList = append(merged.PrefixList, prefix)
+		}
+
+		key := func(k string) string {
+			if s.name == defaultNamespace {
+				return k
+			}
+			return s.name + ":" + k
+		}
+		for region, services := range s.prefixes.RegionToService {
+			merged.RegionToService[key(region)] = services
+		}
+		for service, regions := range s.prefixes.ServiceToRegion {
+			merged.ServiceToRegion[key(service)] = regions
+		}
+		for group, services := range s.prefixes.BorderGroupToService {
+			merged.BorderGroupToService[key(group)] = services
+		}
+		for service, groups := range s.prefixes.ServiceToBorderGroup {
+			merged.ServiceToBorderGroup[key(service)] = groups
+		}
+	}
+	return merged
+}
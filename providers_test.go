@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func prefixStrings(p *Prefixes) []string {
+	var got []string
+	for _, v := range p.PrefixList {
+		got = append(got, v.Region+" "+v.Service+" "+v.Prefix.String())
+	}
+	return got
+}
+
+func TestProviders(t *testing.T) {
+	tests := []struct {
+		provider  string
+		input     string
+		syncToken int64
+		expect    []string
+	}{
+		{
+			provider: "gcp",
+			input: `{
+				"syncToken": "1697479383316",
+				"creationTime": "2023-10-16T11:03:03.316",
+				"prefixes": [
+					{"ipv4Prefix": "34.80.0.0/15", "service": "Google Cloud", "scope": "asia-east1"},
+					{"ipv6Prefix": "2600:1900:4030::/44", "service": "Google Cloud", "scope": "asia-east1"}
+				]
+			}`,
+			syncToken: 1697479383316,
+			expect:    []string{"asia-east1 Google Cloud 34.80.0.0/15"},
+		},
+		{
+			provider: "azure",
+			input: `{
+				"changeNumber": 256,
+				"values": [
+					{"name": "AzureCloud.eastus", "properties": {"region": "eastus", "addressPrefixes": ["4.156.0.0/15", "2603:1030::/45"]}},
+					{"name": "ActionGroup", "properties": {"region": "", "addressPrefixes": ["4.145.74.52/30"]}}
+				]
+			}`,
+			syncToken: 256,
+			expect:    []string{"eastus AzureCloud 4.156.0.0/15", "global ActionGroup 4.145.74.52/30"},
+		},
+		{
+			provider: "cloudflare",
+			input:    `{"result": {"ipv4_cidrs": ["173.245.48.0/20"], "ipv6_cidrs": ["2400:cb00::/32"]}, "success": true}`,
+			expect:   []string{"global CLOUDFLARE 173.245.48.0/20"},
+		},
+		{
+			provider: "cloudflare",
+			input:    "173.245.48.0/20\n103.21.244.0/22\n",
+			expect:   []string{"global CLOUDFLARE 173.245.48.0/20", "global CLOUDFLARE 103.21.244.0/22"},
+		},
+		{
+			provider: "github",
+			input: `{
+				"verifiable_password_authentication": true,
+				"ssh_key_fingerprints": {"SHA256_RSA": "uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"},
+				"hooks": ["192.30.252.0/22"],
+				"web": ["140.82.112.0/20", "2a0a:a440::/29"],
+				"domains": {"website": ["*.github.com"]}
+			}`,
+			expect: []string{"global hooks 192.30.252.0/22", "global web 140.82.112.0/20"},
+		},
+		{
+			provider: "oracle",
+			input: `{
+				"last_updated_timestamp": "2023-10-16T22:51:33.661301",
+				"regions": [
+					{"region": "us-phoenix-1", "cidrs": [{"cidr": "129.146.0.0/21", "tags": ["OCI", "OSN"]}]}
+				]
+			}`,
+			syncToken: 1697496693,
+			expect:    []string{"us-phoenix-1 OCI 129.146.0.0/21", "us-phoenix-1 OSN 129.146.0.0/21"},
+		},
+	}
+
+	for _, test := range tests {
+		prefixes, err := providers[test.provider].Parse(false, strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.provider, err)
+			continue
+		}
+		if got := prefixStrings(prefixes); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: expected %v got %v", test.provider, test.expect, got)
+		}
+		if prefixes.SyncToken != test.syncToken {
+			t.Errorf("%s: expected syncToken %d got %d", test.provider, test.syncToken, prefixes.SyncToken)
+		}
+	}
+}
+
+func TestFilterNamespaces(t *testing.T) {
+	aws := &source{name: "aws", prefixes: newPrefixes()}
+	aws.prefixes.addPrefix(Prefix{Prefix: &net.IPNet{IP: net.IP{52, 95, 245, 0}, Mask: net.CIDRMask(24, 32)}, Region: "us-central1", Service: "AMAZON"})
+	gcp := &source{name: "gcp", prefixes: newPrefixes()}
+	gcp.prefixes.addPrefix(Prefix{Prefix: &net.IPNet{IP: net.IP{34, 80, 0, 0}, Mask: net.CIDRMask(15, 32)}, Region: "us-central1", Service: "Google Cloud"})
+
+	merged := mergePrefixes([]*source{aws, gcp})
+
+	if _, found := merged.RegionToService["gcp:us-central1"]; !found {
+		t.Error("Expected gcp regions to be namespaced")
+	}
+
+	got := merged.Filter([]string{"gcp:us-central1:*"})
+	if len(got) != 1 || got[0].Service != "Google Cloud" {
+		t.Errorf("Expected only the gcp prefix got %v", got)
+	}
+
+	got = merged.Filter([]string{"us-central1:*"})
+	if len(got) != 1 || got[0].Service != "AMAZON" {
+		t.Errorf("Expected only the aws prefix got %v", got)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RouteAttrs are the attributes a selection or custom route asks its routes
+// be programmed with, anything left unset falls back to Config.Route. They're
+// written after the selection or network the same way ip route takes them,
+// eg. "via 10.0.0.1 dev eth1 metric 100 table 112". Both an IPv4 and an
+// IPv6 gateway may be given, each is used for routes of its own family.
+// The metric is kept as a pointer so "metric 0" can override Config.Route.
+//
+// Traffic can be spread over several gateways with weighted next hops,
+// eg. "nexthop via 10.0.0.1 weight 2 nexthop via 10.0.0.2 dev tun1". A
+// gateway for the route's family wins over its next hops.
+//
+// A device on its own still goes via the configured gateway, as with ip
+// route "scope link" makes a route straight out of the device instead, eg.
+// "dev wg0 scope link". Blackhole, unreachable or prohibit make routes of
+// that type instead of ones that go anywhere.
+//
+// When the prefixes are announced over BGP the next hop, communities and
+// local preference can be set too, eg. "bgp-nexthop 10.0.0.5 community
+// 65000:100 community no-export local-pref 200".
+type RouteAttrs struct {
+	Gateway     net.IP
+	Gateway6    net.IP
+	Device      string
+	Metric      *int
+	Table       int
+	Nexthops    []Nexthop
+	Type        string
+	Scope       string
+	BGPNextHop  net.IP
+	BGPNextHop6 net.IP
+	Communities []uint32
+	LocalPref   int
+}
+
+// Nexthop is one of several weighted gateways of a multipath route
+type Nexthop struct {
+	Gateway net.IP
+	Device  string
+	Weight  int
+}
+
+// Route is a single destination and how it should be reached
+type Route struct {
+	Dst      *net.IPNet
+	Gateway  net.IP
+	Device   string
+	Metric   int
+	Table    int
+	Nexthops []Nexthop
+	Protocol int
+	Realm    int
+	Type     string
+
+	// How the route is announced over BGP
+	BGPNextHop  net.IP
+	Communities []uint32
+	LocalPref   int
+
+	// native is the route as the kernel reported it, so it can be removed
+	// or put back exactly as it was
+	native interface{}
+}
+
+var routeKeywords = map[string]struct{}{
+	"via":     {},
+	"dev":     {},
+	"metric":  {},
+	"table":   {},
+	"nexthop": {},
+	"scope":   {},
+
+	"bgp-nexthop": {},
+	"community":   {},
+	"local-pref":  {},
+}
+
+// routeTypes are the types a route can be besides a unicast route that goes
+// somewhere, unicast is there to override a configured type
+var routeTypes = map[string]struct{}{
+	"unicast":     {},
+	"blackhole":   {},
+	"unreachable": {},
+	"prohibit":    {},
+}
+
+func isRouteKeyword(field string) bool {
+	_, found := routeKeywords[field]
+	if !found {
+		_, found = routeTypes[field]
+	}
+	return found
+}
+
+func validateRouteType(routeType string) error {
+	if _, found := routeTypes[routeType]; !found && routeType != "" {
+		return fmt.Errorf("unknown route type %q, expected blackhole, unreachable, prohibit or unicast", routeType)
+	}
+	return nil
+}
+
+// parseRouteAttr parses a keyword and its value from the start of fields,
+// returning how many fields were used
+func (r *RouteAttrs) parseRouteAttr(fields []string) (int, error) {
+	keyword := fields[0]
+	if _, found := routeTypes[keyword]; found {
+		r.Type = keyword
+		return 1, nil
+	}
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("missing value for %s", keyword)
+	}
+	value := fields[1]
+
+	switch keyword {
+	case "via":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return 0, fmt.Errorf("bad gateway %q", value)
+		}
+		if ip.To4() != nil {
+			r.Gateway = ip.To4()
+		} else {
+			r.Gateway6 = ip
+		}
+	case "dev":
+		r.Device = value
+	case "scope":
+		if value != "link" {
+			return 0, fmt.Errorf("bad scope %q, only link is supported", value)
+		}
+		r.Scope = value
+	case "metric":
+		metric, err := strconv.Atoi(value)
+		if err != nil || metric < 0 {
+			return 0, fmt.Errorf("bad metric %q", value)
+		}
+		r.Metric = &metric
+	case "table":
+		table, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || table == 0 {
+			return 0, fmt.Errorf("bad table %q", value)
+		}
+		r.Table = int(table)
+	case "nexthop":
+		nexthop, n, err := parseNexthop(fields[1:])
+		if err != nil {
+			return 0, err
+		}
+		r.Nexthops = append(r.Nexthops, nexthop)
+		return n + 1, nil
+	case "bgp-nexthop":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return 0, fmt.Errorf("bad bgp next hop %q", value)
+		}
+		if ip.To4() != nil {
+			r.BGPNextHop = ip.To4()
+		} else {
+			r.BGPNextHop6 = ip
+		}
+	case "community":
+		community, err := parseCommunity(value)
+		if err != nil {
+			return 0, err
+		}
+		r.Communities = append(r.Communities, community)
+	case "local-pref":
+		localPref, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad local-pref %q", value)
+		}
+		r.LocalPref = int(localPref)
+	default:
+		return 0, fmt.Errorf("unknown route attribute %q", keyword)
+	}
+	return 2, nil
+}
+
+// parseNexthop parses the via, dev and weight following a nexthop keyword
+// the same way ip route does, returning how many fields were used
+func parseNexthop(fields []string) (nexthop Nexthop, n int, err error) {
+	for ; n+1 < len(fields); n += 2 {
+		value := fields[n+1]
+		switch fields[n] {
+		case "via":
+			if nexthop.Gateway = net.ParseIP(value); nexthop.Gateway == nil {
+				return nexthop, 0, fmt.Errorf("bad nexthop gateway %q", value)
+			}
+			if ip4 := nexthop.Gateway.To4(); ip4 != nil {
+				nexthop.Gateway = ip4
+			}
+		case "dev":
+			nexthop.Device = value
+		case "weight":
+			if nexthop.Weight, err = strconv.Atoi(value); err != nil || nexthop.Weight < 1 || nexthop.Weight > 256 {
+				return nexthop, 0, fmt.Errorf("bad nexthop weight %q", value)
+			}
+		default:
+			return nexthop, n, nexthop.validate()
+		}
+	}
+	return nexthop, n, nexthop.validate()
+}
+
+func (n *Nexthop) validate() error {
+	if n.Gateway == nil {
+		return errors.New("nexthop is missing a gateway")
+	}
+	if n.Weight < 0 || n.Weight > 256 {
+		return fmt.Errorf("bad nexthop weight %d", n.Weight)
+	}
+	if n.Weight == 0 {
+		n.Weight = 1
+	}
+	return nil
+}
+
+func (n Nexthop) String() string {
+	s := []string{"nexthop", "via", n.Gateway.String()}
+	if n.Device != "" {
+		s = append(s, "dev", n.Device)
+	}
+	if n.Weight > 1 {
+		s = append(s, "weight", strconv.Itoa(n.Weight))
+	}
+	return strings.Join(s, " ")
+}
+
+// familyNexthops returns the next hops with gateways of the given family
+func familyNexthops(nexthops []Nexthop, ipv6 bool) []Nexthop {
+	var found []Nexthop
+	for _, v := range nexthops {
+		if (v.Gateway.To4() == nil) == ipv6 {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+// ParseRouteAttrs parses a list of route attributes
+func ParseRouteAttrs(fields []string) (attrs RouteAttrs, err error) {
+	for i := 0; i < len(fields); {
+		n, err := attrs.parseRouteAttr(fields[i:])
+		if err != nil {
+			return attrs, err
+		}
+		i += n
+	}
+	return attrs, nil
+}
+
+func (r RouteAttrs) String() string {
+	var s []string
+	if r.Gateway != nil {
+		s = append(s, "via", r.Gateway.String())
+	}
+	if r.Gateway6 != nil {
+		s = append(s, "via", r.Gateway6.String())
+	}
+	if r.Device != "" {
+		s = append(s, "dev", r.Device)
+	}
+	if r.Metric != nil {
+		s = append(s, "metric", strconv.Itoa(*r.Metric))
+	}
+	if r.Table != 0 {
+		s = append(s, "table", strconv.Itoa(r.Table))
+	}
+	for _, v := range r.Nexthops {
+		s = append(s, v.String())
+	}
+	if r.Type != "" {
+		s = append(s, r.Type)
+	}
+	if r.Scope != "" {
+		s = append(s, "scope", r.Scope)
+	}
+	if r.BGPNextHop != nil {
+		s = append(s, "bgp-nexthop", r.BGPNextHop.String())
+	}
+	if r.BGPNextHop6 != nil {
+		s = append(s, "bgp-nexthop", r.BGPNextHop6.String())
+	}
+	for _, v := range r.Communities {
+		s = append(s, "community", communityString(v))
+	}
+	if r.LocalPref != 0 {
+		s = append(s, "local-pref", strconv.Itoa(r.LocalPref))
+	}
+	return strings.Join(s, " ")
+}
+
+// CustomRoute is a network added by hand, optionally followed by its own
+// route attributes, eg. "10.0.0.0/8 via 192.168.0.1"
+type CustomRoute struct {
+	*net.IPNet
+	RouteAttrs
+}
+
+// ParseCustomRoute parses a network and its route attributes
+func ParseCustomRoute(s string) (*CustomRoute, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty custom route")
+	}
+
+	_, network, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("custom route %q: %v", s, err)
+	}
+
+	attrs, err := ParseRouteAttrs(fields[1:])
+	if err != nil {
+		return nil, fmt.Errorf("custom route %q: %v", s, err)
+	}
+	return &CustomRoute{IPNet: network, RouteAttrs: attrs}, nil
+}
+
+func (c *CustomRoute) String() string {
+	if attrs := c.RouteAttrs.String(); attrs != "" {
+		return c.IPNet.String() + " " + attrs
+	}
+	return c.IPNet.String()
+}
+
+func (c *CustomRoute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *CustomRoute) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	tmp, err := ParseCustomRoute(s)
+	if err != nil {
+		return err
+	}
+	*c = *tmp
+	return nil
+}
+
+// resolveRoute works out how a destination should be routed, filling in
+// whatever the attributes leave unset from the configured defaults
+func (c *Config) resolveRoute(dst *net.IPNet, attrs RouteAttrs) *Route {
+	route := &Route{
+		Dst:      dst,
+		Gateway:  attrs.Gateway,
+		Device:   attrs.Device,
+		Metric:   c.Route.Metric,
+		Table:    attrs.Table,
+		Protocol: c.Route.Protocol,
+		Realm:    c.Route.Realm,
+	}
+
+	ipv6 := dst.IP.To4() == nil
+	gateway, nexthops := c.Route.actualGateway, c.Route.Nexthops
+	if ipv6 {
+		route.Gateway, gateway = attrs.Gateway6, c.Route.actualGateway6
+	}
+
+	// The most specific of gateway or next hops wins, the selection's own
+	// before the configured ones. Scope link means a device route, from the
+	// selection or the configuration.
+	scope := attrs.Scope
+	if scope == "" {
+		scope = c.Route.Scope
+	}
+	if route.Gateway == nil {
+		if route.Nexthops = familyNexthops(attrs.Nexthops, ipv6); route.Nexthops == nil && scope != "link" {
+			if route.Nexthops = familyNexthops(nexthops, ipv6); route.Nexthops == nil {
+				route.Gateway = gateway
+			}
+		}
+	}
+
+	if route.Device == "" {
+		route.Device = c.Route.Device
+	}
+	if route.Device == "" && ipv6 && route.Gateway != nil && route.Gateway.Equal(c.Route.actualGateway6) {
+		route.Device = c.Route.actualDevice6
+	}
+	if attrs.Metric != nil {
+		route.Metric = *attrs.Metric
+	}
+	if route.Table == 0 {
+		route.Table = c.Route.Table
+	}
+
+	if route.Type = attrs.Type; route.Type == "" {
+		route.Type = c.Route.Type
+	}
+	if route.Type == "unicast" {
+		route.Type = ""
+	}
+	if route.Type != "" {
+		route.Gateway, route.Device, route.Nexthops = nil, "", nil
+	}
+
+	if route.BGPNextHop = attrs.BGPNextHop; ipv6 {
+		route.BGPNextHop = attrs.BGPNextHop6
+	}
+	if route.Communities = attrs.Communities; route.Communities == nil {
+		route.Communities = c.BGP.communities
+	}
+	if route.LocalPref = attrs.LocalPref; route.LocalPref == 0 {
+		route.LocalPref = c.BGP.LocalPref
+	}
+	return route
+}
+
+// deviceOnly reports if the route goes straight out of a device
+func (r *Route) deviceOnly() bool {
+	return r.Type == "" && r.Gateway == nil && len(r.Nexthops) == 0 && r.Device != ""
+}
+
+// attrsKey identifies routes programmed the same way, regardless of where
+// they're going
+func (r *Route) attrsKey() string {
+	return fmt.Sprintf("%d|%s|%s|%d|%v|%d|%s|%s", r.Table, r.Gateway, r.Device, r.Metric, r.Nexthops, r.Realm, r.Type, r.bgpKey())
+}
+
+// key identifies the route in the kernel
+func (r *Route) key() string {
+	return fmt.Sprintf("%d|%s", r.Table, r.Dst)
+}
+
+func (r *Route) String() string {
+	s := []string{r.Dst.String()}
+	if r.Type != "" {
+		s = append([]string{r.Type}, s...)
+	}
+	if r.Gateway != nil {
+		s = append(s, "via", r.Gateway.String())
+	}
+	if r.Device != "" {
+		s = append(s, "dev", r.Device)
+	}
+	if r.Metric != 0 {
+		s = append(s, "metric", strconv.Itoa(r.Metric))
+	}
+	s = append(s, "table", strconv.Itoa(r.Table))
+	if r.Protocol != 0 {
+		s = append(s, "proto", strconv.Itoa(r.Protocol))
+	}
+	if r.Realm != 0 {
+		s = append(s, "realm", strconv.Itoa(r.Realm))
+	}
+	for _, v := range r.Nexthops {
+		s = append(s, v.String())
+	}
+	return strings.Join(s, " ")
+}
+
+// aggregateRoutes collapses routes that are programmed the same way without
+// changing where any address goes. A route is only dropped when the nearest
+// route covering it, whatever its attributes, is programmed the same way and
+// two halves are only merged when nothing in the table goes to the whole
+func aggregateRoutes(routes []*Route) []*Route {
+	byKey := make(map[string]*Route, len(routes))
+	for _, v := range routes {
+		route := *v
+		route.Dst = normaliseNetwork(v.Dst)
+		// Only one route to a destination can be programmed
+		if _, found := byKey[route.key()]; !found {
+			byKey[route.key()] = &route
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, v := range routeList(byKey) {
+			if byKey[v.key()] != v {
+				// Merged into its parent already
+				continue
+			}
+			if cover := coveringRoute(byKey, v); cover != nil && cover.attrsKey() == v.attrsKey() {
+				delete(byKey, v.key())
+				changed = true
+				continue
+			}
+
+			ones, bits := v.Dst.Mask.Size()
+			if ones == 0 {
+				continue
+			}
+			sibling := &Route{Table: v.Table, Dst: &net.IPNet{IP: append(net.IP(nil), v.Dst.IP...), Mask: v.Dst.Mask}}
+			sibling.Dst.IP[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+			parent := *v
+			parent.Dst = &net.IPNet{IP: v.Dst.IP.Mask(net.CIDRMask(ones-1, bits)), Mask: net.CIDRMask(ones-1, bits)}
+			if other, found := byKey[sibling.key()]; !found || other.attrsKey() != v.attrsKey() {
+				continue
+			}
+			if _, taken := byKey[parent.key()]; taken {
+				continue
+			}
+			delete(byKey, v.key())
+			delete(byKey, sibling.key())
+			byKey[parent.key()] = &parent
+			changed = true
+		}
+	}
+	return routeList(byKey)
+}
+
+// coveringRoute returns the most specific other route in the same table
+// covering the route
+func coveringRoute(byKey map[string]*Route, r *Route) *Route {
+	ones, bits := r.Dst.Mask.Size()
+	for n := ones - 1; n >= 0; n-- {
+		mask := net.CIDRMask(n, bits)
+		cover := Route{Table: r.Table, Dst: &net.IPNet{IP: r.Dst.IP.Mask(mask), Mask: mask}}
+		if found, ok := byKey[cover.key()]; ok {
+			return found
+		}
+	}
+	return nil
+}
+
+// routeList returns the routes sorted
+func routeList(byKey map[string]*Route) []*Route {
+	routes := make([]*Route, 0, len(byKey))
+	for _, v := range byKey {
+		routes = append(routes, v)
+	}
+	sortRoutes(routes)
+	return routes
+}
+
+func sortRoutes(routes []*Route) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Table != routes[j].Table {
+			return routes[i].Table < routes[j].Table
+		}
+		return routes[i].Dst.String() < routes[j].Dst.String()
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCustomRoute(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/8":                          "10.0.0.0/8",
+		"10.0.0.0/8 via 192.168.0.1":          "10.0.0.0/8 via 192.168.0.1",
+		"10.1.2.3/8  dev eth1 metric 100":     "10.0.0.0/8 dev eth1 metric 100",
+		"2600:1f18::/32 via fe80::1 table 12": "2600:1f18::/32 via fe80::1 table 12",
+		"10.0.0.0/8 blackhole metric 5":       "10.0.0.0/8 metric 5 blackhole",
+		"10.0.0.0/8 community 65000:100 community no-export local-pref 200":               "10.0.0.0/8 community 65000:100 community no-export local-pref 200",
+		"10.0.0.0/8 nexthop via 10.0.0.1 weight 2 nexthop via 10.0.0.2 dev tun1 metric 5": "10.0.0.0/8 metric 5 nexthop via 10.0.0.1 weight 2 nexthop via 10.0.0.2 dev tun1",
+	}
+	for input, expect := range tests {
+		custom, err := ParseCustomRoute(input)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", input, err)
+			continue
+		}
+		if got := custom.String(); got != expect {
+			t.Errorf("Expected %q got %q", expect, got)
+		}
+	}
+
+	for _, input := range []string{"", "10.0.0.0", "10.0.0.0/8 via", "10.0.0.0/8 via nowhere", "10.0.0.0/8 metric -1", "10.0.0.0/8 table 0", "10.0.0.0/8 proto static", "10.0.0.0/8 nexthop dev tun0", "10.0.0.0/8 nexthop via 10.0.0.1 weight 0", "10.0.0.0/8 nexthop via 10.0.0.1 weight", "10.0.0.0/8 community 65536:1", "10.0.0.0/8 local-pref high"} {
+		if _, err := ParseCustomRoute(input); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestSelectedRouteAttrs(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	prefixes := newPrefixes()
+	prefixes.addPrefix(Prefix{Prefix: network("52.94.0.0/24"), Region: "us-east-1", Service: "S3"})
+	prefixes.addPrefix(Prefix{Prefix: network("52.94.1.0/24"), Region: "us-east-1", Service: "S3"})
+	prefixes.addPrefix(Prefix{Prefix: network("52.95.0.0/24"), Region: "us-east-1", Service: "EC2"})
+	prefixes.addPrefix(Prefix{IPv6: true, Prefix: network("2600:1f18::/32"), Region: "us-east-1", Service: "S3"})
+	prefixes.sortLookups()
+
+	a := &app{
+		config:     &Config{},
+		prefixes:   prefixes,
+		selections: []string{"us-east-1:S3 via 10.0.0.2 via fe80::2 table 5", "us-east-1:*"},
+		customs:    []*CustomRoute{{IPNet: network("52.94.1.0/24"), RouteAttrs: RouteAttrs{Device: "eth1"}}},
+	}
+	a.config.Route.Table = 111
+	a.config.Route.Metric = 10
+	a.config.Route.actualGateway = net.ParseIP("10.0.0.1").To4()
+	a.config.Route.actualGateway6 = net.ParseIP("fe80::1")
+
+	var got []string
+	for _, v := range a.selectedRoutes() {
+		got = append(got, v.String())
+	}
+	expect := []string{
+		"2600:1f18::/32 via fe80::2 metric 10 table 5",
+		"52.94.0.0/24 via 10.0.0.2 metric 10 table 5",
+		"52.94.1.0/24 via 10.0.0.2 metric 10 table 5",
+		"52.94.1.0/24 via 10.0.0.1 dev eth1 metric 10 table 111",
+		"52.95.0.0/24 via 10.0.0.1 metric 10 table 111",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+
+	a.config.Route.Aggregate = true
+	got = got[:0]
+	for _, v := range a.routes() {
+		got = append(got, v.String())
+	}
+	expect = []string{
+		"2600:1f18::/32 via fe80::2 metric 10 table 5",
+		"52.94.0.0/23 via 10.0.0.2 metric 10 table 5",
+		"52.94.1.0/24 via 10.0.0.1 dev eth1 metric 10 table 111",
+		"52.95.0.0/24 via 10.0.0.1 metric 10 table 111",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected aggregated %v got %v", expect, got)
+	}
+}
+
+func TestAggregateRoutesOverlapping(t *testing.T) {
+	route := func(s string) *Route {
+		custom, err := ParseCustomRoute(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Route{Dst: custom.IPNet, Gateway: custom.Gateway}
+	}
+	aggregate := func(routes ...*Route) []string {
+		var got []string
+		for _, v := range aggregateRoutes(routes) {
+			got = append(got, v.String())
+		}
+		return got
+	}
+
+	// The /24 is closer to the /20 than the /16 it's programmed like
+	got := aggregate(route("52.0.0.0/16 via 10.0.0.1"), route("52.0.0.0/20 via 10.0.0.2"), route("52.0.1.0/24 via 10.0.0.1"), route("52.0.2.0/24 via 10.0.0.2"))
+	expect := []string{"52.0.0.0/16 via 10.0.0.1 table 0", "52.0.0.0/20 via 10.0.0.2 table 0", "52.0.1.0/24 via 10.0.0.1 table 0"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected nested routes %v got %v", expect, got)
+	}
+
+	// The halves can't become the /24 that's already going elsewhere
+	got = aggregate(route("54.0.0.0/25 via 10.0.0.1"), route("54.0.0.128/25 via 10.0.0.1"), route("54.0.0.0/24 via 10.0.0.2"), route("54.0.2.0/24 via 10.0.0.1"), route("54.0.3.0/24 via 10.0.0.1"))
+	expect = []string{"54.0.0.0/24 via 10.0.0.2 table 0", "54.0.0.0/25 via 10.0.0.1 table 0", "54.0.0.128/25 via 10.0.0.1 table 0", "54.0.2.0/23 via 10.0.0.1 table 0"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected halves to be left alone %v got %v", expect, got)
+	}
+}
+
+func TestResolveRouteNexthops(t *testing.T) {
+	_, dst4, _ := net.ParseCIDR("52.94.0.0/24")
+	_, dst6, _ := net.ParseCIDR("2600:1f18::/32")
+
+	c := &Config{}
+	c.Route.Table = 111
+	c.Route.actualGateway = net.ParseIP("10.0.0.1").To4()
+	c.Route.actualGateway6 = net.ParseIP("fe80::1")
+	c.Route.Nexthops = []Nexthop{
+		{Gateway: net.ParseIP("10.0.1.1").To4(), Device: "tun0", Weight: 1},
+		{Gateway: net.ParseIP("10.0.2.1").To4(), Device: "tun1", Weight: 3},
+	}
+
+	tests := []struct {
+		dst    *net.IPNet
+		attrs  string
+		expect string
+	}{
+		{dst4, "", "52.94.0.0/24 table 111 nexthop via 10.0.1.1 dev tun0 nexthop via 10.0.2.1 dev tun1 weight 3"},
+		{dst4, "via 10.0.0.2", "52.94.0.0/24 via 10.0.0.2 table 111"},
+		{dst4, "nexthop via 10.0.3.1 nexthop via fe80::3", "52.94.0.0/24 table 111 nexthop via 10.0.3.1"},
+		{dst6, "", "2600:1f18::/32 via fe80::1 table 111"},
+		{dst6, "via 10.0.0.2 nexthop via fe80::2 nexthop via fe80::3", "2600:1f18::/32 table 111 nexthop via fe80::2 nexthop via fe80::3"},
+		{dst4, "dev wg0", "52.94.0.0/24 dev wg0 table 111 nexthop via 10.0.1.1 dev tun0 nexthop via 10.0.2.1 dev tun1 weight 3"},
+		{dst4, "dev wg0 scope link", "52.94.0.0/24 dev wg0 table 111"},
+		{dst4, "dev wg0 via 10.0.0.2", "52.94.0.0/24 via 10.0.0.2 dev wg0 table 111"},
+		{dst4, "unreachable via 10.0.0.2", "unreachable 52.94.0.0/24 table 111"},
+	}
+	for _, test := range tests {
+		attrs, err := ParseRouteAttrs(strings.Fields(test.attrs))
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.attrs, err)
+			continue
+		}
+		if got := c.resolveRoute(test.dst, attrs).String(); got != test.expect {
+			t.Errorf("Expected %q got %q", test.expect, got)
+		}
+	}
+}
+
+func TestResolveRouteGateway6Device(t *testing.T) {
+	_, dst6, _ := net.ParseCIDR("2600:1f18::/32")
+
+	c := &Config{}
+	c.Route.actualGateway6 = net.ParseIP("fe80::1")
+	c.Route.actualDevice6 = "eth0"
+	c.Route.Table = 111
+
+	tests := []struct {
+		attrs  string
+		expect string
+	}{
+		{"", "2600:1f18::/32 via fe80::1 dev eth0 table 111"},
+		{"via fe80::2 dev eth1", "2600:1f18::/32 via fe80::2 dev eth1 table 111"},
+		{"via 2001:db8::1", "2600:1f18::/32 via 2001:db8::1 table 111"},
+	}
+	for _, test := range tests {
+		attrs, err := ParseRouteAttrs(strings.Fields(test.attrs))
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.attrs, err)
+			continue
+		}
+		if got := c.resolveRoute(dst6, attrs).String(); got != test.expect {
+			t.Errorf("Expected %q got %q", test.expect, got)
+		}
+	}
+}
+
+func TestResolveRouteMetric(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("52.94.0.0/24")
+
+	c := &Config{}
+	c.Route.Metric = 10
+	c.Route.actualGateway = net.ParseIP("10.0.0.1").To4()
+
+	tests := []struct {
+		attrs  string
+		expect int
+	}{
+		{"", 10},
+		{"metric 20", 20},
+		{"metric 0", 0},
+	}
+	for _, test := range tests {
+		attrs, err := ParseRouteAttrs(strings.Fields(test.attrs))
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.attrs, err)
+			continue
+		}
+		if attrs.String() != test.attrs {
+			t.Errorf("Expected %q to round trip got %q", test.attrs, attrs.String())
+		}
+		if got := c.resolveRoute(dst, attrs).Metric; got != test.expect {
+			t.Errorf("Expected metric %d for %q got %d", test.expect, test.attrs, got)
+		}
+	}
+}
+
+func TestResolveRouteConfigScope(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("52.94.0.0/24")
+
+	c := &Config{}
+	c.Route.Table = 111
+	c.Route.Device = "wg0"
+	c.Route.Scope = "link"
+	c.Route.actualGateway = net.ParseIP("10.0.0.1").To4()
+
+	tests := []struct {
+		attrs  string
+		expect string
+	}{
+		{"", "52.94.0.0/24 dev wg0 table 111"},
+		{"via 10.0.0.2", "52.94.0.0/24 via 10.0.0.2 dev wg0 table 111"},
+	}
+	for _, test := range tests {
+		attrs, err := ParseRouteAttrs(strings.Fields(test.attrs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.resolveRoute(dst, attrs).String(); got != test.expect {
+			t.Errorf("Expected %q for %q got %q", test.expect, test.attrs, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	gct "github.com/freman/go-commontypes"
+)
+
+const defaultRulePriority = 100
+
+// RuleConfig is a policy routing rule that steers traffic into a route
+// table, every condition that's left unset matches all traffic. A rule
+// without source subnets is added for both IPv4 and IPv6.
+type RuleConfig struct {
+	From     []gct.Network
+	Mark     uint32
+	Mask     uint32
+	IIF      string
+	Priority int
+	Table    int
+}
+
+// Rule is a single ip rule as it's programmed
+type Rule struct {
+	IPv6     bool
+	Src      *net.IPNet
+	Mark     uint32
+	Mask     uint32
+	IIF      string
+	Priority int
+	Table    int
+	Protocol int
+
+	// native is the rule as the kernel reported it
+	native interface{}
+}
+
+// rules expands the configured rules into what should be programmed
+func (c *Config) rules() []*Rule {
+	var rules []*Rule
+	for _, v := range c.Route.Rules {
+		rule := Rule{Mark: v.Mark, Mask: v.Mask, IIF: v.IIF, Priority: v.Priority, Table: v.Table, Protocol: c.Route.Protocol}
+		if rule.Table == 0 {
+			rule.Table = c.Route.Table
+		}
+		if rule.Priority == 0 {
+			rule.Priority = defaultRulePriority
+		}
+		if rule.Mark != 0 && rule.Mask == 0 {
+			rule.Mask = 0xffffffff
+		}
+
+		if len(v.From) == 0 {
+			ipv4, ipv6 := rule, rule
+			ipv6.IPv6 = true
+			rules = append(rules, &ipv4)
+			if c.IPv6 {
+				rules = append(rules, &ipv6)
+			}
+			continue
+		}
+
+		for _, from := range v.From {
+			src := rule
+			src.Src, src.IPv6 = from.IPNet, from.IP.To4() == nil
+			if !src.IPv6 || c.IPv6 {
+				rules = append(rules, &src)
+			}
+		}
+	}
+	return rules
+}
+
+func (r *Rule) String() string {
+	s := []string{"from", "all"}
+	if r.IPv6 {
+		s = append([]string{"-6"}, s...)
+	}
+	if r.Src != nil {
+		s[len(s)-1] = r.Src.String()
+	}
+	if r.Mark != 0 {
+		s = append(s, "fwmark", fmt.Sprintf("%#x/%#x", r.Mark, r.Mask))
+	}
+	if r.IIF != "" {
+		s = append(s, "iif", r.IIF)
+	}
+	s = append(s, "lookup", strconv.Itoa(r.Table), "priority", strconv.Itoa(r.Priority))
+	if r.Protocol != 0 {
+		s = append(s, "proto", strconv.Itoa(r.Protocol))
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	gct "github.com/freman/go-commontypes"
+)
+
+func TestConfigRules(t *testing.T) {
+	network := func(s string) gct.Network {
+		_, n, _ := net.ParseCIDR(s)
+		return gct.Network{IPNet: n}
+	}
+
+	c := &Config{}
+	c.Route.Table = 111
+	c.Route.Rules = []RuleConfig{
+		{From: []gct.Network{network("10.1.0.0/16"), network("fd00:1::/64")}},
+		{Mark: 0x10, IIF: "eth1", Priority: 110, Table: 112},
+	}
+
+	rulesOf := func() []string {
+		var rules []string
+		for _, v := range c.rules() {
+			rules = append(rules, v.String())
+		}
+		return rules
+	}
+
+	expect := []string{
+		"from 10.1.0.0/16 lookup 111 priority 100",
+		"from all fwmark 0x10/0xffffffff iif eth1 lookup 112 priority 110",
+	}
+	if got := rulesOf(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+
+	c.IPv6 = true
+	expect = []string{
+		"from 10.1.0.0/16 lookup 111 priority 100",
+		"-6 from fd00:1::/64 lookup 111 priority 100",
+		"from all fwmark 0x10/0xffffffff iif eth1 lookup 112 priority 110",
+		"-6 from all fwmark 0x10/0xffffffff iif eth1 lookup 112 priority 110",
+	}
+	if got := rulesOf(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+}
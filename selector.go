@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Selector picks prefixes out of the imported range lists, it's parsed from
+// a selection in the form
+//
+//	[!][provider:]region[@border-group]:service [ipv4|ipv6] [/len|/min-max]
+//
+// Every name may be a glob, eg. "ap-*:EC2", the provider defaults to aws and
+// a missing region in front of a border group means any region. A leading !
+// removes the listings it matches from what the other selections import.
+// The prefix length can be limited to an exact length or a range, either end
+// of which may be left open, eg. "/24", "/16-24" or "/-20".
+//
+// Route attributes can follow, the routes for any prefixes the selection
+// imports will be programmed with them, eg. "*:S3 via 10.0.0.1 dev eth1",
+// "*:EC2 dev wg0 scope link" or "*:EC2 blackhole".
+type Selector struct {
+	Negate      bool
+	Provider    string
+	Region      string
+	BorderGroup string
+	Service     string
+	Family      int
+	MinLength   int
+	MaxLength   int
+	Attrs       RouteAttrs
+}
+
+// ParseSelector parses a single selection
+func ParseSelector(selection string) (*Selector, error) {
+	fields := strings.Fields(selection)
+	if len(fields) == 0 {
+		return nil, errors.New("empty selector")
+	}
+
+	// Service names can contain spaces, so the selector runs up to the first
+	// field that's recognisably a qualifier
+	i := 1
+	for ; i < len(fields) && !isQualifier(fields[i]); i++ {
+	}
+
+	sel, err := parseSelectorNames(strings.Join(fields[:i], " "))
+	if err != nil {
+		return nil, fmt.Errorf("selector %q: %v", selection, err)
+	}
+
+	for i < len(fields) {
+		n := 1
+		if isRouteKeyword(fields[i]) {
+			n, err = sel.Attrs.parseRouteAttr(fields[i:])
+		} else {
+			err = sel.parseQualifier(fields[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %v", selection, err)
+		}
+		i += n
+	}
+
+	if sel.Negate && sel.Attrs.String() != "" {
+		return nil, fmt.Errorf("selector %q: negated selections can't have route attributes", selection)
+	}
+
+	return sel, nil
+}
+
+// ParseSelectors parses a list of selections, reporting every invalid one
+func ParseSelectors(selections []string) ([]*Selector, error) {
+	var errs []string
+	selectors := make([]*Selector, 0, len(selections))
+	for _, v := range selections {
+		sel, err := ParseSelector(v)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		selectors = append(selectors, sel)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return selectors, nil
+}
+
+func isQualifier(field string) bool {
+	return field == "ipv4" || field == "ipv6" || strings.HasPrefix(field, "/") || isRouteKeyword(field)
+}
+
+func parseSelectorNames(s string) (*Selector, error) {
+	sel := &Selector{Provider: defaultNamespace, MaxLength: 128}
+	if strings.HasPrefix(s, "!") {
+		sel.Negate, s = true, strings.TrimSpace(s[1:])
+	}
+
+	sp := strings.Split(s, ":")
+	switch len(sp) {
+	case 2:
+	case 3:
+		sel.Provider, sp = sp[0], sp[1:]
+	default:
+		return nil, errors.New("expected [provider:]region:service")
+	}
+
+	sel.Region, sel.Service = sp[0], sp[1]
+	if i := strings.Index(sel.Region, "@"); i >= 0 {
+		sel.Region, sel.BorderGroup = sel.Region[:i], sel.Region[i+1:]
+		if sel.Region == "" {
+			sel.Region = "*"
+		}
+		if sel.BorderGroup == "" {
+			return nil, errors.New("missing border group after @")
+		}
+	} else {
+		sel.BorderGroup = "*"
+	}
+
+	for _, v := range [][2]string{{"provider", sel.Provider}, {"region", sel.Region}, {"border group", sel.BorderGroup}, {"service", sel.Service}} {
+		name, pattern := v[0], v[1]
+		if pattern == "" {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad %s pattern %q", name, pattern)
+		}
+	}
+
+	return sel, nil
+}
+
+func (sel *Selector) parseQualifier(field string) error {
+	switch field {
+	case "ipv4", "ipv6":
+		family := 4
+		if field == "ipv6" {
+			family = 6
+		}
+		if sel.Family != 0 && sel.Family != family {
+			return errors.New("ipv4 and ipv6 can't be combined")
+		}
+		sel.Family = family
+		return nil
+	}
+
+	if !strings.HasPrefix(field, "/") {
+		return fmt.Errorf("unknown qualifier %q", field)
+	}
+
+	lengths := strings.SplitN(field[1:], "-", 2)
+	min, max := lengths[0], lengths[0]
+	if len(lengths) == 2 {
+		max = lengths[1]
+	}
+	if min == "" && max == "" {
+		return fmt.Errorf("bad prefix length %q", field)
+	}
+
+	var err error
+	if min != "" {
+		if sel.MinLength, err = strconv.Atoi(min); err != nil || sel.MinLength < 0 || sel.MinLength > 128 {
+			return fmt.Errorf("bad prefix length %q", field)
+		}
+	}
+	if max != "" {
+		if sel.MaxLength, err = strconv.Atoi(max); err != nil || sel.MaxLength < 0 || sel.MaxLength > 128 {
+			return fmt.Errorf("bad prefix length %q", field)
+		}
+	}
+	if sel.MinLength > sel.MaxLength {
+		return fmt.Errorf("prefix length %q is back to front", field)
+	}
+	return nil
+}
+
+func globMatch(pattern, name string) bool {
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// Match reports if the prefix is selected, negation is left to the caller
+func (sel *Selector) Match(prefix Prefix) bool {
+	if sel.Family == 4 && prefix.IPv6 || sel.Family == 6 && !prefix.IPv6 {
+		return false
+	}
+
+	if ones, _ := prefix.Prefix.Mask.Size(); ones < sel.MinLength || ones > sel.MaxLength {
+		return false
+	}
+
+	return globMatch(sel.Provider, prefix.Namespace()) &&
+		globMatch(sel.Region, prefix.Region) &&
+		globMatch(sel.BorderGroup, prefix.NetworkBorderGroup) &&
+		globMatch(sel.Service, prefix.Service)
+}
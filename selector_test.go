@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := map[string]string{
+		"us-east-1:EC2":           "",
+		"gcp:us-central1:*":       "",
+		"!*:AMAZON":               "",
+		"! *:AMAZON":              "",
+		"ap-*:EC2 ipv6 /32-48":    "",
+		"gcp:*:Google Cloud ipv4": "",
+		"@us-east-1-bos-1:*":      "",
+		"us-east-1@us-east-1-*:*": "",
+		"*:* /-24":                "",
+		"foo":                     `selector "foo": expected [provider:]region:service`,
+		"a:b:c:d":                 `selector "a:b:c:d": expected [provider:]region:service`,
+		":EC2":                    `selector ":EC2": missing region`,
+		"us-east-1:":              `selector "us-east-1:": missing service`,
+		"us-east-1@:EC2":          `selector "us-east-1@:EC2": missing border group after @`,
+		"us-[east-1:EC2":          `selector "us-[east-1:EC2": bad region pattern "us-[east-1"`,
+		"*:* ipv4 ipv6":           `selector "*:* ipv4 ipv6": ipv4 and ipv6 can't be combined`,
+		"*:* /24-16":              `selector "*:* /24-16": prefix length "/24-16" is back to front`,
+		"*:* /129":                `selector "*:* /129": bad prefix length "/129"`,
+		"*:* /-":                  `selector "*:* /-": bad prefix length "/-"`,
+		"":                        `empty selector`,
+		"*:* ipv4 bogus":          `selector "*:* ipv4 bogus": unknown qualifier "bogus"`,
+	}
+
+	for selection, expect := range tests {
+		_, err := ParseSelector(selection)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != expect {
+			t.Errorf("Expected %q to give %q got %q", selection, expect, got)
+		}
+	}
+}
+
+func TestFilterSelectors(t *testing.T) {
+	network := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+
+	prefixes := newPrefixes()
+	for _, v := range []Prefix{
+		{Prefix: network("18.208.0.0/13"), Region: "us-east-1", NetworkBorderGroup: "us-east-1", Service: "AMAZON"},
+		{Prefix: network("18.208.0.0/13"), Region: "us-east-1", NetworkBorderGroup: "us-east-1", Service: "EC2"},
+		{Prefix: network("52.95.245.0/24"), Region: "us-east-1", NetworkBorderGroup: "us-east-1-bos-1", Service: "AMAZON"},
+		{Prefix: network("13.236.0.0/14"), Region: "ap-southeast-2", NetworkBorderGroup: "ap-southeast-2", Service: "EC2"},
+		{Prefix: network("52.95.36.0/22"), Region: "ap-southeast-2", NetworkBorderGroup: "ap-southeast-2", Service: "S3"},
+		{IPv6: true, Prefix: network("2406:da1c::/36"), Region: "ap-southeast-2", NetworkBorderGroup: "ap-southeast-2", Service: "EC2"},
+		{Prefix: network("34.80.0.0/15"), Region: "asia-east1", Service: "Google Cloud", Provider: "gcp"},
+	} {
+		prefixes.addPrefix(v)
+	}
+
+	tests := []struct {
+		with   []string
+		expect []string
+	}{
+		{[]string{"ap-*:EC2"}, []string{"13.236.0.0/14", "2406:da1c::/36"}},
+		{[]string{"ap-*:EC2 ipv4"}, []string{"13.236.0.0/14"}},
+		{[]string{"ap-*:* ipv6"}, []string{"2406:da1c::/36"}},
+		{[]string{"*:* /20-24"}, []string{"52.95.245.0/24", "52.95.36.0/22"}},
+		{[]string{"*:AMAZON /-14 ipv4", "*:S3 /-14"}, []string{"18.208.0.0/13"}},
+		// Negation works on the listing, the same network listed as EC2 stays
+		{[]string{"us-east-1:*", "!*:AMAZON"}, []string{"18.208.0.0/13"}},
+		{[]string{"!*:AMAZON", "ap-*:*"}, []string{"13.236.0.0/14", "52.95.36.0/22", "2406:da1c::/36"}},
+		{[]string{"us-east-1:AMAZON", "!@us-east-1-bos-1:*"}, []string{"18.208.0.0/13"}},
+		{[]string{"*:*:*"}, []string{"18.208.0.0/13", "18.208.0.0/13", "52.95.245.0/24", "13.236.0.0/14", "52.95.36.0/22", "2406:da1c::/36", "34.80.0.0/15"}},
+		{[]string{"g*:*:Google *"}, []string{"34.80.0.0/15"}},
+		{[]string{"!*:*"}, []string{}},
+		{[]string{"foo", "ap-southeast-2:S3"}, []string{"52.95.36.0/22"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, v := range prefixes.Filter(test.with) {
+			got = append(got, v.Prefix.String())
+		}
+		if len(got) != len(test.expect) {
+			t.Errorf("Expected %v to select %v got %v", test.with, test.expect, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expect[i] {
+				t.Errorf("Expected %v to select %v got %v", test.with, test.expect, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is somewhere the routes are programmed, any number of them can be
+// enabled at once and each is applied on its own so a failing sink doesn't
+// hold up the others
+type Sink interface {
+	// Plan works out what applying the routes would change
+	Plan(routes []*Route) (*Plan, error)
+	// Apply programs the routes
+	Apply(routes []*Route) error
+	// Status reports how the sink is doing
+	Status() SinkStatus
+}
+
+// SinkStatus is the health of a sink as of its last apply
+type SinkStatus struct {
+	Name      string
+	Healthy   bool
+	LastApply time.Time
+	Routes    int
+	Detail    string `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+// sinks are the known sinks by name
+var sinks = map[string]func(a *app) Sink{
+	"netlink":  func(a *app) Sink { return &kernelSink{sinkState: sinkState{name: "netlink"}, a: a} },
+	"nftables": func(a *app) Sink { return &nftSink{sinkState: sinkState{name: "nftables"}, a: a} },
+	"ipset":    func(a *app) Sink { return &ipsetSink{sinkState: sinkState{name: "ipset"}, a: a} },
+	"bgp":      func(a *app) Sink { return &bgpSink{sinkState: sinkState{name: "bgp"}, a: a} },
+	"file":     func(a *app) Sink { return &fileSink{sinkState: sinkState{name: "file"}, a: a} },
+}
+
+const defaultSink = "netlink"
+
+// sink reports if the named sink is enabled
+func (c *Config) sink(name string) bool {
+	for _, v := range c.Sinks {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sinkState is what a sink remembers of its last apply. Sinks that can't
+// read back what they programmed plan by comparing the routes they last
+// applied with the new ones
+type sinkState struct {
+	name string
+
+	lock      sync.Mutex
+	applied   []*Route
+	lastApply time.Time
+	lastError error
+}
+
+// record remembers the outcome of an apply and passes the error on
+func (s *sinkState) record(routes []*Route, err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastApply, s.lastError = time.Now(), err
+	if err == nil {
+		s.applied = routes
+	}
+	return err
+}
+
+func (s *sinkState) Plan(routes []*Route) (*Plan, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	plan := &Plan{}
+	applied := make(map[string]*Route, len(s.applied))
+	for _, v := range s.applied {
+		applied[v.Dst.String()+"|"+v.attrsKey()] = v
+	}
+	for _, v := range routes {
+		key := v.Dst.String() + "|" + v.attrsKey()
+		if _, found := applied[key]; found {
+			delete(applied, key)
+			plan.Unchanged++
+			continue
+		}
+		plan.Add = append(plan.Add, v)
+	}
+	for _, v := range s.applied {
+		if _, found := applied[v.Dst.String()+"|"+v.attrsKey()]; found {
+			plan.Remove = append(plan.Remove, v)
+		}
+	}
+	return plan, nil
+}
+
+// planNetworks compares the networks a sink wants with the ones it has
+func planNetworks(wanted, current []*net.IPNet) *Plan {
+	plan := &Plan{}
+	have := make(map[string]struct{}, len(current))
+	for _, v := range current {
+		have[v.String()] = struct{}{}
+	}
+	for _, v := range wanted {
+		if _, found := have[v.String()]; found {
+			delete(have, v.String())
+			plan.Unchanged++
+			continue
+		}
+		plan.Add = append(plan.Add, &Route{Dst: v})
+	}
+	for _, v := range current {
+		if _, found := have[v.String()]; found {
+			delete(have, v.String())
+			plan.Remove = append(plan.Remove, &Route{Dst: v})
+		}
+	}
+	return plan
+}
+
+func (s *sinkState) Status() SinkStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := SinkStatus{Name: s.name, Healthy: s.lastError == nil, LastApply: s.lastApply, Routes: len(s.applied)}
+	if s.lastError != nil {
+		status.LastError = s.lastError.Error()
+	}
+	return status
+}
+
+// kernelSink programs routes and rules into the kernel over netlink
+type kernelSink struct {
+	sinkState
+	a *app
+}
+
+func (s *kernelSink) Plan(routes []*Route) (*Plan, error) {
+	return planKernelRoutes(s.a, routes)
+}
+
+func (s *kernelSink) Apply(routes []*Route) error {
+	return s.record(routes, setKernelRoutes(s.a, routes))
+}
+
+// nftSink keeps nftables named sets of the destinations
+type nftSink struct {
+	sinkState
+	a *app
+}
+
+// Plan compares the aggregated destinations with the sets' contents
+func (s *nftSink) Plan(routes []*Route) (*Plan, error) {
+	current, err := nftSetNetworks(s.a)
+	if err != nil {
+		return nil, err
+	}
+	return planNetworks(aggregateNetworks(destinations(routes)), current), nil
+}
+
+func (s *nftSink) Apply(routes []*Route) error {
+	return s.record(routes, setNftSets(s.a, routes))
+}
+
+// ipsetSink keeps ipset hash:net sets of the destinations
+type ipsetSink struct {
+	sinkState
+	a *app
+}
+
+// Plan compares the aggregated destinations with the sets' contents
+func (s *ipsetSink) Plan(routes []*Route) (*Plan, error) {
+	current, err := ipsetContents(s.a)
+	if err != nil {
+		return nil, err
+	}
+	return planNetworks(ipsetNetworks(aggregateNetworks(destinations(routes))), current), nil
+}
+
+func (s *ipsetSink) Apply(routes []*Route) error {
+	return s.record(routes, setIPSets(s.a, routes))
+}
+
+// enabledSinks returns the enabled sinks in the order they're configured,
+// creating them the first time they're needed and closing any that have
+// since been disabled
+func (a *app) enabledSinks() []Sink {
+	a.sinksLock.Lock()
+	defer a.sinksLock.Unlock()
+
+	if a.sinks == nil {
+		a.sinks = map[string]Sink{}
+	}
+	for name, sink := range a.sinks {
+		if !a.config.sink(name) {
+			if closer, ok := sink.(interface{ Close() }); ok {
+				closer.Close()
+			}
+			delete(a.sinks, name)
+		}
+	}
+
+	enabled := make([]Sink, 0, len(a.config.Sinks))
+	for _, name := range a.config.Sinks {
+		if a.sinks[name] == nil {
+			a.sinks[name] = sinks[name](a)
+		}
+		enabled = append(enabled, a.sinks[name])
+	}
+	return enabled
+}
+
+// enabledSink returns the named sink if it's enabled
+func (a *app) enabledSink(name string) Sink {
+	if !a.config.sink(name) {
+		return nil
+	}
+	a.enabledSinks()
+
+	a.sinksLock.Lock()
+	defer a.sinksLock.Unlock()
+	return a.sinks[name]
+}
+
+// SetRoutes programs the routes into every enabled sink, a sink that fails
+// or panics doesn't stop the others. The PAC file is rendered again the next
+// time it's fetched
+func SetRoutes(a *app) error {
+	a.invalidatePAC()
+	routes := a.routes()
+
+	var errs []string
+	for _, sink := range a.enabledSinks() {
+		if err := applySink(sink, routes); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", sink.Status().Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func applySink(sink Sink, routes []*Route) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			if state, ok := sink.(interface{ record([]*Route, error) error }); ok {
+				state.record(routes, err)
+			}
+		}
+	}()
+	return sink.Apply(routes)
+}
+
+// PlanRoutes works out what programming the routes into the kernel would
+// change without changing anything, there's nothing to change when the
+// netlink sink isn't enabled
+func PlanRoutes(a *app, routes []*Route) (*Plan, error) {
+	sink := a.enabledSink("netlink")
+	if sink == nil {
+		return &Plan{}, nil
+	}
+	return sink.Plan(routes)
+}
+
+// planSinks works out what applying the routes would change in every
+// enabled sink besides the kernel
+func (a *app) planSinks(routes []*Route) (map[string]*Plan, error) {
+	plans := map[string]*Plan{}
+	for _, sink := range a.enabledSinks() {
+		name := sink.Status().Name
+		if name == "netlink" {
+			continue
+		}
+		plan, err := sink.Plan(routes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		plans[name] = plan
+	}
+	return plans, nil
+}
+
+// sinkStatus returns the health of every enabled sink
+func (a *app) sinkStatus() []SinkStatus {
+	var statuses []SinkStatus
+	for _, sink := range a.enabledSinks() {
+		statuses = append(statuses, sink.Status())
+	}
+	return statuses
+}
+
+// splitFamilies splits networks into IPv4 and IPv6
+func splitFamilies(networks []*net.IPNet) (ipv4, ipv6 []*net.IPNet) {
+	for _, v := range networks {
+		if v.IP.To4() != nil {
+			ipv4 = append(ipv4, v)
+		} else {
+			ipv6 = append(ipv6, v)
+		}
+	}
+	return ipv4, ipv6
+}
+
+// ipsetNetworks splits any /0 in two, hash:net sets can't hold them
+func ipsetNetworks(networks []*net.IPNet) []*net.IPNet {
+	split := make([]*net.IPNet, 0, len(networks))
+	for _, v := range networks {
+		if ones, bits := v.Mask.Size(); ones == 0 {
+			low := &net.IPNet{IP: make(net.IP, len(v.IP)), Mask: net.CIDRMask(1, bits)}
+			high := &net.IPNet{IP: make(net.IP, len(v.IP)), Mask: low.Mask}
+			high.IP[0] = 0x80
+			split = append(split, low, high)
+			continue
+		}
+		split = append(split, v)
+	}
+	return split
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIPSetNetworks(t *testing.T) {
+	var input []*net.IPNet
+	for _, v := range []string{"0.0.0.0/0", "10.0.0.0/8", "::/0"} {
+		_, n, _ := net.ParseCIDR(v)
+		input = append(input, n)
+	}
+
+	var got []string
+	for _, v := range ipsetNetworks(input) {
+		got = append(got, v.String())
+	}
+	expect := []string{"0.0.0.0/1", "128.0.0.0/1", "10.0.0.0/8", "::/1", "8000::/1"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v got %v", expect, got)
+	}
+}
+
+type testSink struct {
+	sinkState
+	err error
+}
+
+func (s *testSink) Apply(routes []*Route) error {
+	if s.err == errPanic {
+		panic("test")
+	}
+	return s.record(routes, s.err)
+}
+
+var errPanic = errors.New("panic")
+
+func TestSetRoutesSinks(t *testing.T) {
+	failing := &testSink{sinkState: sinkState{name: "failing"}, err: errors.New("broken")}
+	panicking := &testSink{sinkState: sinkState{name: "panicking"}, err: errPanic}
+	working := &testSink{sinkState: sinkState{name: "working"}}
+	for _, v := range []*testSink{failing, panicking, working} {
+		sink := v
+		sinks[sink.name] = func(a *app) Sink { return sink }
+		defer delete(sinks, sink.name)
+	}
+
+	_, network, _ := net.ParseCIDR("52.94.0.0/24")
+	a := &app{
+		config:   &Config{Sinks: []string{"failing", "panicking", "working"}},
+		prefixes: newPrefixes(),
+		customs:  []*CustomRoute{{IPNet: network}},
+	}
+
+	plan, err := working.Plan(a.routes())
+	if err != nil || len(plan.Add) != 1 || plan.Unchanged != 0 {
+		t.Errorf("Expected 1 route to add got %+v %v", plan, err)
+	}
+
+	err = SetRoutes(a)
+	if expect := "failing: broken\npanicking: panic: test"; err == nil || err.Error() != expect {
+		t.Errorf("Expected %q got %v", expect, err)
+	}
+
+	statuses := a.sinkStatus()
+	if len(statuses) != 3 || statuses[0].Healthy || statuses[1].Healthy || !statuses[2].Healthy || statuses[2].Routes != 1 {
+		t.Errorf("Unexpected sink status %+v", statuses)
+	}
+
+	if plan, _ := working.Plan(a.routes()); len(plan.Add) != 0 || plan.Unchanged != 1 {
+		t.Errorf("Expected 1 unchanged route got %+v", plan)
+	}
+
+	a.config.Sinks = []string{"working"}
+	if statuses := a.sinkStatus(); len(statuses) != 1 || len(a.sinks) != 1 {
+		t.Errorf("Expected only the working sink got %+v", statuses)
+	}
+}
+
+func TestPlanNetworks(t *testing.T) {
+	parse := func(s ...string) []*net.IPNet {
+		var networks []*net.IPNet
+		for _, v := range s {
+			_, n, _ := net.ParseCIDR(v)
+			networks = append(networks, n)
+		}
+		return networks
+	}
+
+	plan := planNetworks(parse("10.0.0.0/23", "52.94.0.0/24"), parse("52.94.0.0/24", "10.0.0.0/24"))
+	if len(plan.Add) != 1 || plan.Add[0].Dst.String() != "10.0.0.0/23" || len(plan.Remove) != 1 || plan.Remove[0].Dst.String() != "10.0.0.0/24" || plan.Unchanged != 1 {
+		t.Errorf("Unexpected plan %+v", plan)
+	}
+}
+
+func TestSinkStatePlanAttributes(t *testing.T) {
+	_, network, _ := net.ParseCIDR("52.94.0.0/24")
+	s := &sinkState{}
+	s.record([]*Route{{Dst: network, Gateway: net.ParseIP("10.0.0.1")}}, nil)
+
+	plan, _ := s.Plan([]*Route{{Dst: network, Gateway: net.ParseIP("10.0.0.2")}})
+	if len(plan.Add) != 1 || len(plan.Remove) != 1 || plan.Unchanged != 0 {
+		t.Errorf("Expected a changed gateway to be removed and added got %+v", plan)
+	}
+}
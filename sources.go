@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// source is a single range list being imported, each has its own cache
+// file, polling timer and selection namespace
+type source struct {
+	name     string
+	file     string
+	provider Provider
+	config   SourceConfig
+	timer    *time.Timer
+	done     chan struct{}
+	prefixes *Prefixes
+	// stale is set while running on the cached copy because the source
+	// couldn't be refreshed, err holds the reason
+	stale bool
+	err   error
+	// retrying is set while the source is being refreshed in the background
+	retrying bool
+}
+
+// sources returns every configured source, AWS is always the first
+func (c *Config) sources() []SourceConfig {
+	aws := SourceConfig{
+		Name:        defaultNamespace,
+		Provider:    defaultNamespace,
+		URL:         c.URL,
+		MinPrefixes: c.MinPrefixes,
+		Polling:     c.Polling,
+	}
+	return append([]SourceConfig{aws}, c.Sources...)
+}
+
+// newSource creates a source, the provider has to be one we know
+func newSource(cfg SourceConfig) (*source, error) {
+	provider, found := providers[cfg.Provider]
+	if !found {
+		return nil, fmt.Errorf("unknown provider %q for source %q", cfg.Provider, cfg.Name)
+	}
+
+	s := &source{
+		name:     cfg.Name,
+		file:     cfg.Name + "-ranges.json",
+		provider: provider,
+		config:   cfg,
+		done:     make(chan struct{}),
+	}
+	if cfg.Name == defaultNamespace {
+		s.file = "ip-ranges.json"
+	}
+
+	if cfg.Polling.Enabled {
+		s.timer = time.NewTimer(cfg.Polling.Interval.Duration)
+	} else {
+		s.timer = time.NewTimer(5 * time.Minute)
+		s.timer.Stop()
+	}
+	return s, nil
+}
+
+func (s *source) resetPolling() {
+	if s.config.Polling.Enabled {
+		s.timer.Reset(s.config.Polling.Interval.Duration)
+	} else {
+		s.timer.Stop()
+	}
+}
+
+func (s *source) stop() {
+	s.timer.Stop()
+	close(s.done)
+}
+
+// sourceList returns the sources, the list is replaced rather than changed
+// so it's safe to range over after the lock is released
+func (a *app) sourceList() []*source {
+	a.sourcesLock.RLock()
+	defer a.sourcesLock.RUnlock()
+	return a.sources
+}
+
+// mergedPrefixes returns the prefixes of every source, they're replaced
+// rather than changed so they're safe to use after the lock is released
+func (a *app) mergedPrefixes() *Prefixes {
+	a.sourcesLock.RLock()
+	defer a.sourcesLock.RUnlock()
+	return a.prefixes
+}
+
+// refreshed records the prefixes a source now has and merges the prefixes
+// of every source again
+func (a *app) refreshed(s *source, prefixes *Prefixes, stale bool, err error) {
+	a.sourcesLock.Lock()
+	defer a.sourcesLock.Unlock()
+
+	s.prefixes, s.stale, s.err = prefixes, stale, err
+	a.prefixes = mergePrefixes(a.sources)
+}
+
+// failed records why a source couldn't be refreshed
+func (a *app) failed(s *source, err error) {
+	a.sourcesLock.Lock()
+	defer a.sourcesLock.Unlock()
+
+	s.err = err
+}
+
+func (a *app) source(name string) *source {
+	for _, s := range a.sourceList() {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (a *app) pollingUpdate(s *source) {
+	for {
+		select {
+		case <-s.timer.C:
+			a.log.Println("Polling for new", s.file)
+			a.updateSource(s)
+			SetRoutes(a)
+			s.resetPolling()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (a *app) reloadSources() {
+	a.sourcesLock.Lock()
+	defer a.sourcesLock.Unlock()
+
+	existing := map[string]*source{}
+	for _, s := range a.sources {
+		existing[s.name] = s
+	}
+
+	var sources, added []*source
+	for _, cfg := range a.config.sources() {
+		s, found := existing[cfg.Name]
+		if found && s.config.Provider == cfg.Provider {
+			delete(existing, cfg.Name)
+			pollingChanged := s.config.Polling != cfg.Polling
+			s.config = cfg
+			if pollingChanged {
+				if cfg.Polling.Enabled {
+					a.log.Println("Polling change detected for", s.name, "enabling polling every", cfg.Polling.Interval.Duration)
+				} else {
+					a.log.Println("Polling change detected for", s.name, "disabling polling")
+				}
+				s.resetPolling()
+			}
+			sources = append(sources, s)
+			continue
+		}
+
+		s, err := newSource(cfg)
+		if err != nil {
+			a.log.Println("Not adding source:", err)
+			continue
+		}
+		a.log.Println("Adding", cfg.Provider, "source", cfg.Name)
+		sources = append(sources, s)
+		added = append(added, s)
+	}
+
+	for _, s := range existing {
+		a.log.Println("Removing source", s.name)
+		s.stop()
+	}
+
+	a.sources = sources
+	a.prefixes = mergePrefixes(a.sources)
+
+	for _, s := range added {
+		go a.pollingUpdate(s)
+	}
+
+	if len(added) > 0 || len(existing) > 0 {
+		go func() {
+			for _, s := range added {
+				a.updateSource(s)
+			}
+			SetRoutes(a)
+		}()
+	}
+}
@@ -4,6 +4,7 @@ import Dashboard from '@/components/Dashboard.vue'
 import Config from '@/components/Config.vue'
 import Imports from '@/components/Imports.vue'
 import Custom from '@/components/Custom.vue'
+import Changes from '@/components/Changes.vue'
 
 Vue.use(Router)
 
@@ -28,6 +29,11 @@ export default new Router({
       path: "/custom",
       name: 'custom',
       component: Custom,
+    },
+    {
+      path: "/changes",
+      name: 'changes',
+      component: Changes,
     }
   ]
 })
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"time"
+)
+
+const maxDriftEvents = 100
+const defaultWatchDebounce = 5 * time.Second
+
+// DriftEvent is a change to the kernel that awsrangenf didn't make, found
+// and put right after the route watcher saw something happen
+type DriftEvent struct {
+	Time   time.Time
+	Change string
+	Route  string
+}
+
+// watchMaxDebounces caps how long a steady stream of changes can put off
+// a drift check, counted in debounces from the first change
+const watchMaxDebounces = 6
+
+// watchDrift re-converges the kernel when the watcher reports something
+// changed, waiting for things to settle first so a flush or interface flap
+// is dealt with in one go. A pending signal on linked means a device went
+// up or down in the meantime, so device routes get failed over first.
+func (a *app) watchDrift(changed, linked <-chan struct{}) {
+	debounce(changed, func() time.Duration {
+		if a.config.Watch.Debounce.Duration > 0 {
+			return a.config.Watch.Debounce.Duration
+		}
+		return defaultWatchDebounce
+	}, func() {
+		select {
+		case <-linked:
+			a.linksChanged()
+		default:
+		}
+		a.checkDrift()
+	})
+}
+
+// debounce calls check once there have been no changes for the wait, or
+// at the latest watchMaxDebounces waits after the first change
+func debounce(changed <-chan struct{}, wait func() time.Duration, check func()) {
+	var settled <-chan time.Time
+	var deadline time.Time
+	for {
+		select {
+		case _, ok := <-changed:
+			if !ok {
+				return
+			}
+			now, delay := time.Now(), wait()
+			if settled == nil {
+				deadline = now.Add(watchMaxDebounces * delay)
+			}
+			if now.Add(delay).After(deadline) {
+				delay = deadline.Sub(now)
+			}
+			settled = time.After(delay)
+		case <-settled:
+			settled = nil
+			check()
+		}
+	}
+}
+
+// checkDrift records anything that no longer matches what was programmed
+// and programs it again
+func (a *app) checkDrift() {
+	if !a.config.Watch.Enabled || !a.ready() {
+		return
+	}
+
+	plan, err := PlanRoutes(a, a.routes())
+	if err != nil {
+		a.log.Println("Unable to check for route drift due to", err)
+		return
+	}
+	if plan.Empty() {
+		return
+	}
+
+	now := time.Now()
+	var events []DriftEvent
+	for _, v := range plan.Add {
+		events = append(events, DriftEvent{Time: now, Change: "missing", Route: v.String()})
+	}
+	for _, v := range plan.Remove {
+		events = append(events, DriftEvent{Time: now, Change: "unexpected", Route: v.String()})
+	}
+	for _, v := range plan.AddRules {
+		events = append(events, DriftEvent{Time: now, Change: "missing rule", Route: v.String()})
+	}
+	for _, v := range plan.RemoveRules {
+		events = append(events, DriftEvent{Time: now, Change: "unexpected rule", Route: v.String()})
+	}
+	a.recordDrift(events)
+
+	a.log.Printf("Route drift detected, %d missing and %d unexpected, re-converging", len(plan.Add)+len(plan.AddRules), len(plan.Remove)+len(plan.RemoveRules))
+	if err := SetRoutes(a); err != nil {
+		a.log.Println("Unable to re-converge routes due to", err)
+	}
+}
+
+func (a *app) recordDrift(events []DriftEvent) {
+	a.driftLock.Lock()
+	defer a.driftLock.Unlock()
+
+	a.drift = append(a.drift, events...)
+	if n := len(a.drift); n > maxDriftEvents {
+		a.drift = append([]DriftEvent(nil), a.drift[n-maxDriftEvents:]...)
+	}
+}
+
+// driftEvents returns the recorded drift, most recent first
+func (a *app) driftEvents() []DriftEvent {
+	a.driftLock.Lock()
+	defer a.driftLock.Unlock()
+
+	events := make([]DriftEvent, len(a.drift))
+	for i, v := range a.drift {
+		events[len(a.drift)-1-i] = v
+	}
+	return events
+}
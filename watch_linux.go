@@ -0,0 +1,74 @@
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const watchRetryDelay = 10 * time.Second
+
+// watchRoutes subscribes to route and link updates, anything that touches
+// one of our routes or takes an interface up or down gets drift checked.
+// Routes are dropped without a notification when their interface goes
+// down, hence watching links too, and device routes fail over once the
+// links settle. Which tables are ours is left to the drift check so the
+// receive loop never waits on the netfilter lock.
+func watchRoutes(a *app) {
+	changed := make(chan struct{}, 1)
+	linked := make(chan struct{}, 1)
+	go a.watchDrift(changed, linked)
+
+	notify := func(c chan struct{}) {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		routes := make(chan netlink.RouteUpdate)
+		links := make(chan netlink.LinkUpdate)
+		done := make(chan struct{})
+
+		err := netlink.RouteSubscribe(routes, done)
+		if err == nil {
+			err = netlink.LinkSubscribe(links, done)
+		}
+		if err != nil {
+			close(done)
+			a.log.Println("Unable to watch for route changes due to", err, "will retry in", watchRetryDelay)
+			time.Sleep(watchRetryDelay)
+			continue
+		}
+
+		for routes != nil && links != nil {
+			select {
+			case update, ok := <-routes:
+				if !ok {
+					routes = nil
+					break
+				}
+				if int(update.Protocol) == a.config.Route.Protocol {
+					notify(changed)
+				}
+			case update, ok := <-links:
+				if !ok {
+					links = nil
+					break
+				}
+				if update.Header.Type == syscall.RTM_NEWLINK || update.Header.Type == syscall.RTM_DELLINK {
+					notify(linked)
+					notify(changed)
+				}
+			}
+		}
+
+		close(done)
+		a.log.Println("Lost the route watch subscription, resubscribing in", watchRetryDelay)
+		time.Sleep(watchRetryDelay)
+	}
+}
@@ -0,0 +1,6 @@
+// +build !linux
+
+package main
+
+// watchRoutes does nothing as there's no kernel to watch outside of linux
+func watchRoutes(a *app) {}
@@ -0,0 +1,53 @@
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestCheckDrift(t *testing.T) {
+	defer func() { pretendRoutes = nil }()
+
+	_, network, _ := net.ParseCIDR("52.94.0.0/24")
+	prefixes := newPrefixes()
+	prefixes.addPrefix(Prefix{Prefix: network, Region: "us-east-1", Service: "S3"})
+
+	a := &app{
+		config:     &Config{Sinks: []string{"netlink"}},
+		prefixes:   prefixes,
+		sources:    []*source{{name: defaultNamespace, prefixes: prefixes}},
+		selections: []string{"us-east-1:S3"},
+		log:        log.New(ioutil.Discard, "", 0),
+	}
+	a.config.Watch.Enabled = true
+	a.config.Route.Table = 111
+	a.config.Route.actualGateway = net.ParseIP("10.0.0.1").To4()
+	pretendRoutes = nil
+
+	a.checkDrift()
+	if events := a.driftEvents(); len(events) != 1 || events[0].Change != "missing" {
+		t.Errorf("Expected the missing route to be recorded got %+v", events)
+	}
+	if len(pretendRoutes) != 1 {
+		t.Fatalf("Expected the missing route to be put back got %v", pretendRoutes)
+	}
+
+	_, stray, _ := net.ParseCIDR("10.9.0.0/16")
+	pretendRoutes = append(pretendRoutes, &Route{Dst: stray, Gateway: a.config.Route.actualGateway, Table: 111})
+	a.checkDrift()
+	if events := a.driftEvents(); len(events) != 2 || events[0].Change != "unexpected" || events[0].Route != "10.9.0.0/16 via 10.0.0.1 table 111" {
+		t.Errorf("Expected the unexpected route to be recorded got %+v", events)
+	}
+	if len(pretendRoutes) != 1 {
+		t.Errorf("Expected the unexpected route to be removed got %v", pretendRoutes)
+	}
+
+	a.checkDrift()
+	if events := a.driftEvents(); len(events) != 2 {
+		t.Errorf("Expected no drift once converged got %+v", events)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecordDrift(t *testing.T) {
+	a := &app{}
+	for i := 0; i < maxDriftEvents+10; i++ {
+		a.recordDrift([]DriftEvent{{Change: "missing", Route: fmt.Sprint(i)}})
+	}
+
+	events := a.driftEvents()
+	if len(events) != maxDriftEvents {
+		t.Fatalf("Expected %d events got %d", maxDriftEvents, len(events))
+	}
+	if first, last := events[0].Route, events[len(events)-1].Route; first != fmt.Sprint(maxDriftEvents+9) || last != "10" {
+		t.Errorf("Expected the most recent events first got %s to %s", first, last)
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+	changed := make(chan struct{})
+	checked := make(chan struct{}, 10)
+	go debounce(changed, func() time.Duration { return 20 * time.Millisecond }, func() {
+		checked <- struct{}{}
+	})
+	defer close(changed)
+
+	// Changes every 5ms would put a check off forever without the cap
+	stop := time.After(time.Second)
+	tick := time.NewTicker(5 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			changed <- struct{}{}
+		case <-checked:
+			return
+		case <-stop:
+			t.Fatal("Expected a check while changes kept coming")
+		}
+	}
+}
+
+func TestWatchDriftDrainsLinks(t *testing.T) {
+	a := &app{config: &Config{}}
+	a.config.Watch.Debounce.Duration = 10 * time.Millisecond
+
+	changed := make(chan struct{}, 1)
+	linked := make(chan struct{}, 1)
+	go a.watchDrift(changed, linked)
+	defer close(changed)
+
+	// A link change is picked up by the next debounced check, not straight away
+	linked <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	if len(linked) != 1 {
+		t.Fatal("Expected the link change to wait for the debounce")
+	}
+
+	changed <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for len(linked) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the debounced check to handle the link change")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}